@@ -0,0 +1,243 @@
+package openvpn
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// AuthRequest describes a client that is waiting to be authorized, either
+// because it is connecting (>CLIENT:CONNECT) or because its TLS session is
+// renegotiated (>CLIENT:REAUTH).
+type AuthRequest struct {
+	ClientID string
+	KeyID    string
+	Reauth   bool
+	Env      map[string]string // The >CLIENT:ENV block sent by openvpn
+
+	m       *Management
+	pending *PendingAuth
+}
+
+// Defer tells the library that the answer will be given later through the
+// returned PendingAuth, which may be resolved from any goroutine. Defer must be
+// called before Authorize returns, the AuthResult returned by Authorize is then
+// ignored. Clients not resolved within Process.AuthTimeout are denied.
+func (r *AuthRequest) Defer() *PendingAuth {
+	if r.pending == nil {
+		r.pending = &PendingAuth{
+			ClientID:   r.ClientID,
+			KeyID:      r.KeyID,
+			CommonName: r.CommonName(),
+			Username:   r.Username(),
+			Since:      time.Now(),
+			req:        r,
+		}
+		r.m.deferAuth(r.pending)
+	}
+	return r.pending
+}
+
+func (r *AuthRequest) Username() string {
+	return r.Env["username"]
+}
+func (r *AuthRequest) Password() string {
+	return r.Env["password"]
+}
+func (r *AuthRequest) CommonName() string {
+	if cn, ok := r.Env["X509_0_CN"]; ok {
+		return cn
+	}
+	return r.Env["common_name"]
+}
+
+// PeerInfo returns the IV_ variables pushed by the client (version, platform, ...)
+func (r *AuthRequest) PeerInfo() map[string]string {
+	info := make(map[string]string, 0)
+	for key, val := range r.Env {
+		if strings.HasPrefix(key, "IV_") {
+			info[key] = val
+		}
+	}
+	return info
+}
+
+// AuthResult is the answer from an Authorizer
+type AuthResult struct {
+	Allow        bool
+	Reason       string   // Written to the openvpn log when the client is denied
+	ClientReason string   // Sent to the client when it is denied
+	Config       []string // Client specific config when allowed, ex "ifconfig-push 10.8.0.10 255.255.255.0"
+}
+
+const defaultAuthTimeout = time.Second * 30
+
+func Allow(config ...string) AuthResult {
+	return AuthResult{Allow: true, Config: config}
+}
+func Deny(reason string) AuthResult {
+	return AuthResult{Reason: reason}
+}
+
+// Authorizer decides if a client is allowed to connect to the server. Setting
+// Process.Authorizer enables management-client-auth, after which openvpn waits
+// for the answer before letting any client in. Authorize is called from the
+// goroutine handling the management interface, so slow backends should use
+// AuthRequest.Defer and answer from another goroutine.
+type Authorizer interface {
+	Authorize(req *AuthRequest) AuthResult
+}
+
+// AuthorizerFunc allows a plain function to be used as an Authorizer
+type AuthorizerFunc func(req *AuthRequest) AuthResult
+
+func (f AuthorizerFunc) Authorize(req *AuthRequest) AuthResult {
+	return f(req)
+}
+
+// PendingAuth is a deferred authentication waiting for an answer
+type PendingAuth struct {
+	ClientID   string
+	KeyID      string
+	CommonName string
+	Username   string
+	Since      time.Time
+	Deadline   time.Time // The client is denied if no answer is given before the deadline
+
+	req   *AuthRequest
+	timer *time.Timer
+}
+
+var ErrAuthResolved = errors.New("openvpn: the authentication is already answered, timed out or disconnected")
+
+// Resolve sends the answer for a deferred authentication to openvpn
+func (a *PendingAuth) Resolve(result AuthResult) error {
+	if !a.req.m.takeAuth(a) {
+		return ErrAuthResolved
+	}
+	return a.req.m.sendAuth(a.req, result)
+}
+
+// PendingAuths lists the deferred authentications that are waiting for an answer
+func (p *Process) PendingAuths() []*PendingAuth {
+	return p.management.pendingAuths()
+}
+
+func (m *Management) authorize(req *AuthRequest) { // {{{
+	req.m = m
+	result := m.Conn.Authorizer.Authorize(req)
+
+	// The answer will be given through the PendingAuth
+	if req.pending != nil {
+		return
+	}
+
+	// Let the router continue while openvpn answers
+	go func() {
+		if err := m.sendAuth(req, result); err != nil {
+			log.Error("Management: failed to answer auth for client ", req.ClientID, ": ", err)
+		}
+	}()
+} // }}}
+
+func (m *Management) sendAuth(req *AuthRequest, result AuthResult) (err error) { // {{{
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	id := req.ClientID + " " + req.KeyID
+
+	if !result.Allow {
+		cmd := "client-deny " + id + " " + quote(result.Reason)
+		if result.ClientReason != "" {
+			cmd += " " + quote(result.ClientReason)
+		}
+		_, err = m.Command(ctx, cmd)
+		return
+	}
+
+	if len(result.Config) == 0 {
+		_, err = m.Command(ctx, "client-auth-nt "+id)
+		return
+	}
+
+	// Line breaks would end the config block early
+	config := make([]string, 0, len(result.Config))
+	for _, line := range result.Config {
+		config = append(config, strings.NewReplacer("\r", " ", "\n", " ").Replace(line))
+	}
+
+	_, err = m.command(ctx, "client-auth "+id, append(config, "END")...)
+	return
+} // }}}
+
+func (m *Management) deferAuth(a *PendingAuth) { // {{{
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+
+	timeout := m.Conn.AuthTimeout
+	if timeout <= 0 {
+		timeout = defaultAuthTimeout
+	}
+
+	a.Deadline = a.Since.Add(timeout)
+	a.timer = time.AfterFunc(timeout, func() {
+		if !m.takeAuth(a) {
+			return
+		}
+
+		log.Warn("Management: authentication of client ", a.ClientID, " timed out")
+		if err := m.sendAuth(a.req, Deny("authentication timed out")); err != nil {
+			log.Error("Management: failed to deny client ", a.ClientID, ": ", err)
+		}
+	})
+
+	m.auths[a.ClientID+" "+a.KeyID] = a
+} // }}}
+
+// takeAuth removes a pending authentication, only the first caller gets true
+func (m *Management) takeAuth(a *PendingAuth) bool { // {{{
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+
+	key := a.ClientID + " " + a.KeyID
+	if m.auths[key] != a {
+		return false
+	}
+
+	delete(m.auths, key)
+	a.timer.Stop()
+	return true
+} // }}}
+
+// dropAuths forgets all pending authentications for a disconnected client
+func (m *Management) dropAuths(cid string) { // {{{
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+
+	for key, a := range m.auths {
+		if a.ClientID == cid {
+			log.Info("Management: client ", cid, " disconnected while waiting for authentication")
+			delete(m.auths, key)
+			a.timer.Stop()
+		}
+	}
+} // }}}
+
+func (m *Management) pendingAuths() []*PendingAuth { // {{{
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+
+	list := make([]*PendingAuth, 0, len(m.auths))
+	for _, a := range m.auths {
+		list = append(list, a)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Since.Before(list[j].Since)
+	})
+	return list
+} // }}}
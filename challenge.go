@@ -0,0 +1,153 @@
+package openvpn
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Challenge is a challenge/response question from the server, used for two
+// factor authentication. A static challenge is configured on the client with
+// "static-challenge" and asked together with the password, while a dynamic
+// challenge (CRV1) is sent by the server after the first password is accepted.
+type Challenge struct {
+	Static           bool
+	Echo             bool // The response may be shown while it is typed
+	ResponseRequired bool
+	Text             string
+	StateID          string // Dynamic challenges only
+	Username         string // Dynamic challenges only
+}
+
+// ChallengeResponder answers challenges when running as a client
+type ChallengeResponder interface {
+	Respond(ch *Challenge) (response string, err error)
+}
+
+// ChallengeFunc allows a plain function to be used as a ChallengeResponder
+type ChallengeFunc func(ch *Challenge) (response string, err error)
+
+func (f ChallengeFunc) Respond(ch *Challenge) (response string, err error) {
+	return f(ch)
+}
+
+// Challenge denies the client and asks it to answer a dynamic challenge. The
+// client will reconnect and the answer is available from ChallengeResponse
+// once it does. The stateID is used to pair the answer with the question.
+func (r *AuthRequest) Challenge(stateID, text string, echo bool) AuthResult {
+	flags := "R"
+	if echo {
+		flags += ",E"
+	}
+
+	return AuthResult{
+		Reason:       "challenge sent",
+		ClientReason: "CRV1:" + flags + ":" + stateID + ":" + base64.StdEncoding.EncodeToString([]byte(r.Username())) + ":" + text,
+	}
+}
+
+// ChallengeResponse decodes the answer to a dynamic challenge sent with Challenge
+func (r *AuthRequest) ChallengeResponse() (stateID, response string, ok bool) {
+	parts := strings.SplitN(r.Password(), "::", 3)
+	if len(parts) != 3 || parts[0] != "CRV1" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// StaticChallengeResponse decodes the password and answer sent by a client
+// configured with "static-challenge"
+func (r *AuthRequest) StaticChallengeResponse() (password, response string, ok bool) {
+	parts := strings.SplitN(r.Password(), ":", 3)
+	if len(parts) != 3 || parts[0] != "SCRV1" {
+		return "", "", false
+	}
+
+	p, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", false
+	}
+	resp, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", "", false
+	}
+	return string(p), string(resp), true
+}
+
+// parseDynamicChallenge decodes the text after >PASSWORD:Verification Failed: 'Auth'
+// ex ['CRV1:R,E:Om01u7Fh4LrGBS7uh0SWmzwabUiGiW6l:Y3Ix:Please enter token PIN']
+func parseDynamicChallenge(s string) *Challenge {
+	start := strings.Index(s, "['CRV1:")
+	end := strings.LastIndex(s, "']")
+	if start < 0 || end < start {
+		return nil
+	}
+
+	parts := strings.SplitN(s[start+len("['CRV1:"):end], ":", 4)
+	if len(parts) != 4 {
+		return nil
+	}
+
+	username, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil
+	}
+
+	ch := &Challenge{
+		StateID:  parts[1],
+		Username: string(username),
+		Text:     parts[3],
+	}
+	for _, flag := range strings.Split(parts[0], ",") {
+		switch flag {
+		case "R":
+			ch.ResponseRequired = true
+		case "E":
+			ch.Echo = true
+		}
+	}
+	return ch
+}
+
+// parseStaticChallenge decodes the SC:<flags>,<text> suffix of >PASSWORD:Need 'Auth' username/password
+func parseStaticChallenge(s string) *Challenge {
+	start := strings.Index(s, "SC:")
+	if start < 0 {
+		return nil
+	}
+
+	parts := strings.SplitN(s[start+len("SC:"):], ",", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+
+	flags, _ := strconv.Atoi(parts[0])
+	return &Challenge{
+		Static:           true,
+		Echo:             flags&1 == 1,
+		ResponseRequired: true,
+		Text:             parts[1],
+	}
+}
+
+func (m *Management) respond(ch *Challenge) (string, error) {
+	if m.Conn.ChallengeResponder == nil {
+		return "", errors.New("received a challenge, but no ChallengeResponder is set")
+	}
+	return m.Conn.ChallengeResponder.Respond(ch)
+}
+
+func (m *Management) setChallenge(ch *Challenge) {
+	m.lock.Lock()
+	m.challenge = ch
+	m.lock.Unlock()
+}
+func (m *Management) takeChallenge() *Challenge {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ch := m.challenge
+	m.challenge = nil
+	return ch
+}
@@ -1,13 +1,210 @@
 package openvpn
 
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Client is a session connected to the server, identified by the client ID
+// (CID) openvpn assigns to every connection. Several sessions may share the
+// same common name with duplicate-cn or username-as-common-name.
 type Client struct {
+	ID               string // Client ID (CID) assigned by the openvpn server
 	CommonName       string
+	Username         string
 	PublicIP         string
 	PrivateIP        string
+	PrivateIPv6      string
 	BytesRecived     string
 	BytesSent        string
 	LastRef          string
+	ConnectedSince   time.Time
+	PeerID           string
+	Cipher           string // Data channel cipher
+	Traffic          Traffic
+	Established      bool // Authenticated and the session is up (>CLIENT:ESTABLISHED)
 	waitForPrivateIP chan bool
 	missing          int
+	killed           *KillMode // Set when killed from Process.KillClient and friends
 	Env              map[string]string
 }
+
+// clientIndex keeps the lookup indexes of Process.Clients
+type clientIndex struct {
+	commonName map[string]map[string]*Client // By common name and CID
+	username   map[string]map[string]*Client // By username and CID
+	address    map[string]*Client            // By virtual IPv4 and IPv6 address
+}
+
+func newClientIndex() clientIndex {
+	return clientIndex{
+		commonName: make(map[string]map[string]*Client, 0),
+		username:   make(map[string]map[string]*Client, 0),
+		address:    make(map[string]*Client, 0),
+	}
+}
+
+func (i clientIndex) add(c *Client) {
+	addToIndex(i.commonName, c.CommonName, c)
+	addToIndex(i.username, c.Username, c)
+
+	for _, addr := range []string{c.PrivateIP, c.PrivateIPv6} {
+		if addr != "" {
+			i.address[addr] = c
+		}
+	}
+}
+
+func (i clientIndex) remove(c *Client) {
+	removeFromIndex(i.commonName, c.CommonName, c)
+	removeFromIndex(i.username, c.Username, c)
+
+	for _, addr := range []string{c.PrivateIP, c.PrivateIPv6} {
+		if i.address[addr] == c {
+			delete(i.address, addr)
+		}
+	}
+}
+
+func addToIndex(index map[string]map[string]*Client, key string, c *Client) {
+	if key == "" {
+		return
+	}
+	if index[key] == nil {
+		index[key] = make(map[string]*Client, 1)
+	}
+	index[key][c.ID] = c
+}
+
+func removeFromIndex(index map[string]map[string]*Client, key string, c *Client) {
+	if index[key][c.ID] != c {
+		return
+	}
+	delete(index[key], c.ID)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+// addClient, removeClient and updateClient keeps Process.Clients and the
+// indexes in sync. The caller holds clientLock.
+func (p *Process) addClient(c *Client) {
+	p.Clients[c.ID] = c
+	p.clientIndex.add(c)
+}
+
+func (p *Process) removeClient(c *Client) {
+	delete(p.Clients, c.ID)
+	p.clientIndex.remove(c)
+}
+
+func (p *Process) updateClient(c *Client, update func(c *Client)) {
+	p.clientIndex.remove(c)
+	update(c)
+	p.clientIndex.add(c)
+}
+
+// Client returns a copy of the session with the client ID (CID)
+func (p *Process) Client(cid string) (*Client, bool) {
+	p.clientLock.RLock()
+	defer p.clientLock.RUnlock()
+
+	c, ok := p.Clients[cid]
+	if !ok {
+		return nil, false
+	}
+	return c.copy(), true
+}
+
+// ClientList returns a copy of all connected sessions, ordered by client ID
+func (p *Process) ClientList() []*Client {
+	p.clientLock.RLock()
+	defer p.clientLock.RUnlock()
+
+	return copyClients(p.Clients)
+}
+
+// ClientsByCommonName returns all sessions using the common name
+func (p *Process) ClientsByCommonName(cn string) []*Client {
+	p.clientLock.RLock()
+	defer p.clientLock.RUnlock()
+
+	return copyClients(p.clientIndex.commonName[cn])
+}
+
+// ClientsByUsername returns all sessions authenticated as the username
+func (p *Process) ClientsByUsername(username string) []*Client {
+	p.clientLock.RLock()
+	defer p.clientLock.RUnlock()
+
+	return copyClients(p.clientIndex.username[username])
+}
+
+// ClientByAddress returns the session using a virtual IPv4 or IPv6 address
+func (p *Process) ClientByAddress(addr string) (*Client, bool) {
+	p.clientLock.RLock()
+	defer p.clientLock.RUnlock()
+
+	c, ok := p.clientIndex.address[addr]
+	if !ok {
+		return nil, false
+	}
+	return c.copy(), true
+}
+
+func (c *Client) copy() *Client {
+	cp := *c
+	cp.waitForPrivateIP = nil
+	if c.Env != nil {
+		cp.Env = make(map[string]string, len(c.Env))
+		for key, val := range c.Env {
+			cp.Env[key] = val
+		}
+	}
+	return &cp
+}
+
+func copyClients(clients map[string]*Client) []*Client {
+	list := make([]*Client, 0, len(clients))
+	for _, c := range clients {
+		list = append(list, c.copy())
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		a, errA := strconv.Atoi(list[i].ID)
+		b, errB := strconv.Atoi(list[j].ID)
+		if errA != nil || errB != nil {
+			return list[i].ID < list[j].ID
+		}
+		return a < b
+	})
+	return list
+}
+
+// Traffic holds the byte counters and transfer rates reported by the
+// BYTECOUNT and BYTECOUNT_CLI notifications
+type Traffic struct {
+	BytesIn  uint64
+	BytesOut uint64
+	RateIn   float64 // Bytes per second since the previous update
+	RateOut  float64 // Bytes per second since the previous update
+	Updated  time.Time
+}
+
+func (t *Traffic) update(in, out uint64, now time.Time) {
+	t.RateIn = 0
+	t.RateOut = 0
+
+	// The counters restart from zero when the tunnel is reconnected
+	if !t.Updated.IsZero() && in >= t.BytesIn && out >= t.BytesOut {
+		if d := now.Sub(t.Updated).Seconds(); d > 0 {
+			t.RateIn = float64(in-t.BytesIn) / d
+			t.RateOut = float64(out-t.BytesOut) / d
+		}
+	}
+
+	t.BytesIn = in
+	t.BytesOut = out
+	t.Updated = now
+}
@@ -0,0 +1,178 @@
+package openvpn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+var ErrNotConnected = errors.New("openvpn management interface is not connected")
+
+// abandonedReplyTimeout is how long the reply to a cancelled command is waited
+// for, before openvpn is considered hung and the connection is closed
+var abandonedReplyTimeout = time.Second * 10
+
+// Response is the reply openvpn sent for a single management command. Simple
+// commands are answered with a SUCCESS: or ERROR: line, while commands like
+// "status" or "version" answers with a block of lines terminated by END.
+type Response struct {
+	Command string
+	Success bool
+	Message string   // The text following SUCCESS: or ERROR:
+	Lines   []string // The lines of a multi-line reply, without the END marker
+}
+
+func (r Response) String() string {
+	if len(r.Lines) > 0 {
+		return strings.Join(r.Lines, "\n")
+	}
+	return r.Message
+}
+
+// CommandError is returned by Command when openvpn answers with ERROR:
+type CommandError struct {
+	Command string
+	Message string
+}
+
+func (e *CommandError) Error() string {
+	return "openvpn: command \"" + e.Command + "\" failed: " + e.Message
+}
+
+type pendingCommand struct {
+	command string
+	done    chan Response
+}
+
+// Command sends a single command to openvpn and waits for the reply. Commands
+// are serialized, so concurrent callers will wait for their turn. An ERROR:
+// reply is returned as a *CommandError together with the response.
+func (m *Management) Command(ctx context.Context, cmd string) (Response, error) { // {{{
+	if strings.ContainsAny(cmd, "\r\n") {
+		return Response{Command: cmd}, errors.New("openvpn: management commands can not contain line breaks")
+	}
+
+	return m.command(ctx, cmd)
+} // }}}
+
+func (m *Management) command(ctx context.Context, cmd string, body ...string) (resp Response, err error) { // {{{
+	resp.Command = cmd
+
+	// Wait for our turn
+	select {
+	case m.commands <- true:
+	case <-ctx.Done():
+		return resp, ctx.Err()
+	}
+
+	m.lock.Lock()
+	c := m.conn
+	pc := &pendingCommand{
+		command: cmd,
+		done:    make(chan Response, 1),
+	}
+	if c != nil {
+		m.pending = pc
+	}
+	m.lock.Unlock()
+
+	if c == nil {
+		<-m.commands
+		return resp, ErrNotConnected
+	}
+
+	data := cmd + "\n"
+	for _, line := range body {
+		data += line + "\n"
+	}
+
+	if _, err = c.Write([]byte(data)); err != nil {
+		m.lock.Lock()
+		if m.pending == pc {
+			m.pending = nil
+		}
+		m.lock.Unlock()
+
+		<-m.commands
+		return resp, err
+	}
+
+	select {
+	case r, ok := <-pc.done:
+		<-m.commands
+		if !ok {
+			return resp, ErrNotConnected
+		}
+		if !r.Success {
+			return r, &CommandError{Command: cmd, Message: r.Message}
+		}
+		return r, nil
+	case <-ctx.Done():
+		// The reply will still arrive, keep our turn until it does so it
+		// isnt mistaken for the reply to the next command. If it never does,
+		// openvpn is hung and the connection is closed so the next command
+		// doesnt wait forever.
+		go func() {
+			select {
+			case <-pc.done:
+			case <-time.After(abandonedReplyTimeout):
+				log.Error("Management: no reply to \"", cmd, "\", closing the connection")
+				c.Close()
+				m.disconnected(c)
+			}
+			<-m.commands
+		}()
+		return resp, ctx.Err()
+	}
+} // }}}
+
+// reply hands a reply over to the pending command, it returns false if no
+// command is waiting.
+func (m *Management) reply(msg *message) bool { // {{{
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	pc := m.pending
+	if pc == nil {
+		return false
+	}
+
+	m.pending = nil
+	pc.done <- Response{
+		Command: pc.command,
+		Success: msg.status != "ERROR",
+		Message: msg.payload,
+		Lines:   msg.lines,
+	}
+	return true
+} // }}}
+
+func (m *Management) connected(c net.Conn) { // {{{
+	m.lock.Lock()
+	m.conn = c
+	m.lock.Unlock()
+} // }}}
+func (m *Management) disconnected(c net.Conn) { // {{{
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.conn != c {
+		return
+	}
+	m.conn = nil
+	m.logging = false
+
+	if m.pending != nil {
+		close(m.pending.done)
+		m.pending = nil
+	}
+} // }}}
+
+// quote wraps an argument to a management command in double quotes
+func quote(s string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\r", " ", "\n", " ").Replace(s) + "\""
+}
@@ -1,50 +1,86 @@
 package openvpn
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	log "github.com/cihub/seelog"
 	"github.com/stamp/go-openssl"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 type Config struct {
-	remote string
-	flags  map[string]bool
-	values map[string]string
-	params []string
+	remote     string
+	directives []directive
+	params     []string
+
+	// Argv passes the options to openvpn as command line arguments, instead of
+	// rendering them to a config file started with --config
+	Argv bool
+
+	// Strict makes Validate fail on options it doesnt know, they are only
+	// logged as warnings otherwise
+	Strict bool
+}
+
+// directive is one option, a line in a config file
+type directive struct {
+	name   string
+	args   []string
+	inline string  // The content of an inline block, ex <ca>...</ca>
+	block  *Config // The options of a <connection> block
 }
 
 func NewConfig() *Config {
 	return &Config{
-		flags:  make(map[string]bool),
-		values: make(map[string]string),
-		params: make([]string, 0),
+		directives: make([]directive, 0),
+		params:     make([]string, 0),
 	}
 }
 
-/**
-Loads configuration from the given file, A  configuration is only valid if:
-1. It is a string- In this case, append a # symbol at the end to ignore
-2. Array of flags-- In this case, append # symbol at the end of the flag to ignore it
-3. Array of push params-- Append # as above to ignore a push
-*/
+// LoadFile loads configuration from the given file, A configuration is only valid if:
+// 1. It is a string- In this case, append a # symbol at the end to ignore
+// 2. Array of flags-- In this case, append # symbol at the end of the flag to ignore it
+// 3. Array of push params-- Append # as above to ignore a push
 func (c *Config) LoadFile(filename string) error {
 	cfgFile, err := os.Open(filename)
 	if err != nil {
 		return errors.New("File " + filename + " could not be read: " + err.Error())
 	}
+	defer cfgFile.Close()
+
+	// Native openvpn config files are added as they are
+	reader := bufio.NewReader(cfgFile)
+	if !isJSON(reader) {
+		native, err := ParseConfig(reader)
+		if err != nil {
+			return errors.New("File " + filename + " could not be parsed: " + err.Error())
+		}
+		c.merge(native)
+		return nil
+	}
+
 	var cc interface{}
-	loader := json.NewDecoder(cfgFile)
+	loader := json.NewDecoder(reader)
 	errd := loader.Decode(&cc)
 	if errd != nil {
 		return errors.New("Could not decode JSON file: " + errd.Error())
 	}
 	jmap := cc.(map[string]interface{})
-	for k, v := range jmap {
+
+	// Sorted, so the rendered config is the same every time
+	keys := make([]string, 0, len(jmap))
+	for k := range jmap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := jmap[k]
 		switch vu := v.(type) {
 		case string:
 			s := v.(string)
@@ -60,8 +96,13 @@ func (c *Config) LoadFile(filename string) error {
 				}
 			} else {
 				for _, vv := range vu {
-					if !strings.HasSuffix(vv.(string), "#") {
-						c.Flag(k + " \"" + vv.(string) + "\"")
+					if strings.HasSuffix(vv.(string), "#") {
+						continue
+					}
+					if k == "push" {
+						c.AddPush(vv.(string))
+					} else {
+						c.AddDirective(k, splitValue(k, vv.(string))...)
 					}
 				}
 			}
@@ -73,47 +114,205 @@ func (c *Config) LoadFile(filename string) error {
 	return nil
 }
 
+// Refresh rebuilds the command line arguments used in argv mode
 func (c *Config) Refresh() {
 	c.params = c.params[0:0] //Clear the array first
-	for key, val := range c.values {
-		a := strings.Split("--"+key+" "+val, " ")
-		for _, ar := range a {
-			c.params = append(c.params, ar)
+	for _, d := range c.directives {
+		if d.inline != "" || d.block != nil {
+			continue // Only possible in a config file, see Validate
 		}
+		c.params = append(c.params, "--"+d.name)
+		c.params = append(c.params, d.args...)
 	}
-	for key, val := range c.flags {
-		if val {
-			a := strings.Split("--"+key, " ")
-			for _, er := range a {
-				c.params = append(c.params, er)
-			}
+
+	c.remote = c.firstRemote()
+}
+
+// firstRemote returns the host of the first remote, used to tell if we are a client
+func (c *Config) firstRemote() string {
+	for _, d := range c.directives {
+		if d.name == "remote" && len(d.args) > 0 {
+			return d.args[0]
 		}
 	}
+	for _, d := range c.directives {
+		if d.block != nil && d.block.remote != "" {
+			return d.block.remote
+		}
+	}
+	return ""
 }
 
-/**
-If called for a second time replace the key
-*/
+// Set sets an option, if called for a second time replace the key. The value
+// is used as it is, so backslashes in windows paths are kept. It is split on
+// whitespace only for options taking several arguments, see splitValue.
 func (c *Config) Set(key, val string) {
-	if v, ok := c.values[key]; ok {
-		if v == val { //Skip if already set
+	c.set(key, splitValue(key, val)...)
+}
+
+// splitValue splits a value given to Set into arguments. Options taking a
+// single argument get the whole value, so paths with spaces are kept, while
+// other options and those missing from the catalog are split on whitespace.
+func splitValue(key, val string) []string {
+	if o, ok := optionCatalog[key]; ok && o.max == 1 {
+		if val = strings.TrimSpace(val); val == "" {
+			return nil
+		}
+		return []string{val}
+	}
+	return strings.Fields(val)
+}
+
+// SetQuoted is like Set, but the value uses the config file syntax. Quote
+// arguments containing spaces, ex SetQuoted("ca", `'C:\Program Files\ca.crt'`)
+func (c *Config) SetQuoted(key, val string) error {
+	args, err := splitArgs(val)
+	if err != nil {
+		return errors.New("Invalid value for " + key + ": " + err.Error())
+	}
+	c.set(key, args...)
+	return nil
+}
+
+func (c *Config) set(key string, args ...string) {
+	for i, d := range c.directives {
+		if d.name != key {
+			continue
+		}
+		if d.inline == "" && d.block == nil && equalArgs(d.args, args) { //Skip if already set
 			return
 		}
-		delete(c.values, key)
+
+		// Replace the first, keeping its position, and remove the rest
+		c.directives[i] = directive{name: key, args: args}
+		c.remove(key, i+1)
+		c.Refresh()
+		return
 	}
-	c.values[key] = val
+
+	c.directives = append(c.directives, directive{name: key, args: args})
 	c.Refresh()
 }
 
+// Flag adds an option, ex "persist-tun" or "comp-lzo yes"
 func (c *Config) Flag(key string) {
-	if _, ok := c.flags[key]; ok { //Skip if already set
+	args, err := splitArgs(key)
+	if err != nil || len(args) == 0 {
+		log.Error("Invalid flag ", key, ": ", err)
 		return
 	}
-	c.flags[key] = true
+
+	for _, d := range c.directives {
+		if d.name == args[0] && equalArgs(d.args, args[1:]) { //Skip if already set
+			return
+		}
+	}
+
+	c.directives = append(c.directives, directive{name: args[0], args: args[1:]})
+	c.Refresh()
+}
+
+// AddDirective adds an option that may be given several times, ex
+// AddDirective("route", "10.0.0.0", "255.0.0.0"). The arguments are quoted
+// as needed.
+func (c *Config) AddDirective(name string, args ...string) {
+	c.directives = append(c.directives, directive{name: name, args: args})
+	c.Refresh()
+}
+
+// AddPush adds an option pushed to the clients, ex AddPush("route 10.0.0.0 255.0.0.0")
+func (c *Config) AddPush(option string) {
+	c.AddDirective("push", option)
+}
+
+// AddRoute adds a route, the extra arguments are the gateway and metric
+func (c *Config) AddRoute(network, netmask string, args ...string) {
+	c.AddDirective("route", append([]string{network, netmask}, args...)...)
+}
+
+// AddRemote adds a server to connect to, the proto may be empty. Openvpn
+// tries them in order.
+func (c *Config) AddRemote(host string, port int, proto string) {
+	args := []string{host, strconv.Itoa(port)}
+	if proto != "" {
+		args = append(args, proto)
+	}
+	c.AddDirective("remote", args...)
+}
+
+// Values returns the arguments of every occurrence of the option, in order
+func (c *Config) Values(name string) [][]string {
+	values := make([][]string, 0)
+	for _, d := range c.directives {
+		if d.name == name && d.block == nil && d.inline == "" {
+			values = append(values, append([]string(nil), d.args...))
+		}
+	}
+	return values
+}
+
+// copy returns a copy that can be changed without affecting c
+func (c *Config) copy() *Config {
+	cp := *c
+	cp.directives = append([]directive(nil), c.directives...)
+	cp.params = nil
+	cp.Refresh()
+	return &cp
+}
+
+// Remove removes all occurrences of the option
+func (c *Config) Remove(name string) {
+	c.remove(name, 0)
 	c.Refresh()
 }
 
+// RemoveDirective removes the occurrences of the option with exactly these arguments
+func (c *Config) RemoveDirective(name string, args ...string) {
+	kept := c.directives[:0]
+	for _, d := range c.directives {
+		if d.name != name || d.block != nil || d.inline != "" || !equalArgs(d.args, args) {
+			kept = append(kept, d)
+		}
+	}
+	c.directives = kept
+	c.Refresh()
+}
+
+// RemovePush removes a pushed option
+func (c *Config) RemovePush(option string) {
+	c.RemoveDirective("push", option)
+}
+
+// RemoveRoute removes a route added with AddRoute
+func (c *Config) RemoveRoute(network, netmask string, args ...string) {
+	c.RemoveDirective("route", append([]string{network, netmask}, args...)...)
+}
+
+// remove deletes all directives with the name, starting at index from
+func (c *Config) remove(name string, from int) {
+	kept := c.directives[:from]
+	for _, d := range c.directives[from:] {
+		if d.name != name {
+			kept = append(kept, d)
+		}
+	}
+	c.directives = kept
+}
+
+// Validate checks the options against the option catalog, see options.go.
+// All problems are returned together as ConfigErrors.
 func (c *Config) Validate() (config []string, err error) {
+	errs := c.validate(c.mode(), c.Strict)
+	if c.Argv {
+		for _, d := range c.directives {
+			if d.inline != "" || d.block != nil {
+				errs = append(errs, &ConfigError{Key: d.name, Message: "<" + d.name + "> blocks can only be used in a config file, not with Argv"})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
 	return c.params, nil
 }
 
@@ -122,28 +321,27 @@ func (c *Config) ServerMode(port int, ca *openssl.CA, cert *openssl.Cert, dh *op
 	c.Set("port", strconv.Itoa(port))
 	c.Flag("tls-server")
 
-	c.Set("ca", ca.GetFilePath())
-	c.Set("crl-verify", ca.GetCRLPath())
-	c.Set("cert", cert.GetFilePath())
-	c.Set("key", cert.GetKeyPath())
-	c.Set("dh", dh.GetFilePath())
-	c.Set("tls-auth", ta.GetFilePath()+" 0")
+	c.set("ca", ca.GetFilePath())
+	c.set("crl-verify", ca.GetCRLPath())
+	c.set("cert", cert.GetFilePath())
+	c.set("key", cert.GetKeyPath())
+	c.set("dh", dh.GetFilePath())
+	c.set("tls-auth", ta.GetFilePath(), "0")
 }
 func (c *Config) ClientMode(ca *openssl.CA, cert *openssl.Cert, dh *openssl.DH, ta *openssl.TA) {
 	c.Flag("client")
 	c.Flag("tls-client")
 
-	c.Set("ca", ca.GetFilePath())
-	c.Set("cert", cert.GetFilePath())
-	c.Set("key", cert.GetKeyPath())
-	c.Set("dh", dh.GetFilePath())
-	c.Set("tls-auth", ta.GetFilePath()+" 1")
+	c.set("ca", ca.GetFilePath())
+	c.set("cert", cert.GetFilePath())
+	c.set("key", cert.GetKeyPath())
+	c.set("dh", dh.GetFilePath())
+	c.set("tls-auth", ta.GetFilePath(), "1")
 }
 
 func (c *Config) Remote(r string, port int) {
 	c.Set("port", strconv.Itoa(port))
 	c.Set("remote", r)
-	c.remote = r
 }
 func (c *Config) Protocol(p string) {
 	c.Set("proto", p)
@@ -165,7 +363,7 @@ func (c *Config) IpPool(pool string) {
 }
 
 func (c *Config) Secret(key string) {
-	c.Set("secret", key)
+	c.set("secret", key)
 }
 
 func (c *Config) KeepAlive(interval, timeout int) {
@@ -188,14 +386,23 @@ func (c *Config) ClientToClient() {
 	c.Flag("client-to-client")
 }
 
-func (c *Config) setManagementPath(path string) {
-	if path != "" {
-		c.Set("management", path+" unix")
+// setManagementPath adds the management interface to the config, the
+// directive is the arguments for the "management" option as returned by
+// Management.Start.
+func (c *Config) setManagementPath(directive string, flags ...string) {
+	if directive != "" {
+		if err := c.SetQuoted("management", directive); err != nil {
+			log.Error(err)
+		}
 		c.Flag("management-client")
 		c.Flag("management-hold")
 		c.Flag("management-signal")
 		c.Flag("management-up-down")
 
+		for _, flag := range flags {
+			c.Flag(flag)
+		}
+
 		log.Info("Current config:", c)
 	}
 }
@@ -0,0 +1,472 @@
+package openvpn
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	c := NewConfig()
+	c.Device("tun")
+	c.Set("server", "10.8.0.0 255.255.255.0")
+	c.set("ca", "/etc/open vpn/ca.crt")
+	c.Flag(`push "route 10.0.0.0 255.0.0.0"`)
+	c.Flag(`push "dhcp-option DNS 10.8.0.1"`)
+	c.Flag("persist-tun")
+	c.Flag("persist-tun")
+	c.Set("dev", "tap")
+
+	expected := strings.Join([]string{
+		"dev tap",
+		"server 10.8.0.0 255.255.255.0",
+		`ca "/etc/open vpn/ca.crt"`,
+		`push "route 10.0.0.0 255.0.0.0"`,
+		`push "dhcp-option DNS 10.8.0.1"`,
+		"persist-tun",
+		"",
+	}, "\n")
+	if rendered := c.Render(); rendered != expected {
+		t.Errorf("Invalid config:\n%s\nexpected:\n%s", rendered, expected)
+	}
+
+	params, _ := c.Validate()
+	expectedParams := []string{
+		"--dev", "tap",
+		"--server", "10.8.0.0", "255.255.255.0",
+		"--ca", "/etc/open vpn/ca.crt",
+		"--push", "route 10.0.0.0 255.0.0.0",
+		"--push", "dhcp-option DNS 10.8.0.1",
+		"--persist-tun",
+	}
+	if !equalArgs(params, expectedParams) {
+		t.Error("Invalid argv: ", params)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := map[string][]string{
+		`remote vpn.example.com 1194 udp`:   {"remote", "vpn.example.com", "1194", "udp"},
+		`push "route 10.0.0.0 255.0.0.0"`:   {"push", "route 10.0.0.0 255.0.0.0"},
+		`ca 'C:\Program Files\ca.crt'`:      {"ca", `C:\Program Files\ca.crt`},
+		`ca C:\\ca.crt`:                     {"ca", `C:\ca.crt`},
+		`auth-user-pass "my \"login\".txt"`: {"auth-user-pass", `my "login".txt`},
+		`verb 3 # comment`:                  {"verb", "3"},
+		`; commented out`:                   {},
+		`setenv FOO a#b`:                    {"setenv", "FOO", "a#b"},
+		`setenv FOO ""`:                     {"setenv", "FOO", ""},
+	}
+
+	for line, expected := range tests {
+		args, err := splitArgs(line)
+		if err != nil || !equalArgs(args, expected) {
+			t.Errorf("%s: got %q, %v", line, args, err)
+		}
+
+		// Quoting the arguments must give them back
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = quoteArg(arg)
+		}
+		if again, _ := splitArgs(strings.Join(quoted, " ")); !equalArgs(again, args) {
+			t.Errorf("%s: quoted as %q", line, quoted)
+		}
+	}
+
+	if _, err := splitArgs(`push "route 10.0.0.0`); err == nil {
+		t.Error("Expected an error for a missing quote")
+	}
+}
+
+const testProfile = `# A client profile
+client
+dev tun
+proto udp
+remote vpn.example.com 1194
+remote vpn2.example.com 1194
+route 10.1.0.0 255.255.0.0
+route 10.2.0.0 255.255.0.0
+; verb 9
+verb 3 # default
+auth-user-pass "C:\\Program Files\\OpenVPN\\pass.txt"
+key-direction 1
+
+<connection>
+remote backup.example.com 443 tcp
+</connection>
+
+<ca>
+-----BEGIN CERTIFICATE-----
+MIIB
+-----END CERTIFICATE-----
+</ca>
+<tls-auth>
+-----BEGIN OpenVPN Static key V1-----
+abcd
+-----END OpenVPN Static key V1-----
+</tls-auth>
+`
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig(strings.NewReader(testProfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.remote != "vpn.example.com" {
+		t.Error("Remote not set: ", c.remote)
+	}
+
+	expected := strings.Join([]string{
+		"client",
+		"dev tun",
+		"proto udp",
+		"remote vpn.example.com 1194",
+		"remote vpn2.example.com 1194",
+		"route 10.1.0.0 255.255.0.0",
+		"route 10.2.0.0 255.255.0.0",
+		"verb 3",
+		`auth-user-pass "C:\\Program Files\\OpenVPN\\pass.txt"`,
+		"key-direction 1",
+		"<connection>",
+		"remote backup.example.com 443 tcp",
+		"</connection>",
+		"<ca>",
+		"-----BEGIN CERTIFICATE-----",
+		"MIIB",
+		"-----END CERTIFICATE-----",
+		"</ca>",
+		"<tls-auth>",
+		"-----BEGIN OpenVPN Static key V1-----",
+		"abcd",
+		"-----END OpenVPN Static key V1-----",
+		"</tls-auth>",
+		"",
+	}, "\n")
+	rendered := c.Render()
+	if rendered != expected {
+		t.Errorf("Invalid config:\n%s\nexpected:\n%s", rendered, expected)
+	}
+
+	// The rendered config parses to the same config
+	if again, err := ParseConfig(strings.NewReader(rendered)); err != nil || again.Render() != rendered {
+		t.Error("Round trip failed: ", err)
+	}
+
+	// Inline blocks can't be passed on the command line
+	c.Argv = true
+	if _, err := c.Validate(); err == nil {
+		t.Error("Expected an error for inline blocks with Argv")
+	}
+
+	// A client only using <connection> blocks
+	if c, err := ParseConfig(strings.NewReader("client\n<connection>\nremote backup.example.com 443 tcp\n</connection>\n")); err != nil || c.remote != "backup.example.com" {
+		t.Error("Remote not found in the connection block: ", err)
+	}
+
+	for _, invalid := range []string{
+		"<ca>\nMIIB\n",
+		"<connection>\n<connection>\n</connection>\n</connection>\n",
+		"</ca>\n",
+		"<management>\n</management>\n",
+		"push \"route 10.0.0.0\n",
+	} {
+		if _, err := ParseConfig(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestLoadFileNative(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "client.ovpn")
+	if err := ioutil.WriteFile(filename, []byte(testProfile), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConfig()
+	c.Flag("persist-tun")
+	if err := c.LoadFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(c.Render(), "persist-tun\nclient\n") || c.remote != "vpn.example.com" {
+		t.Error("The native config was not loaded: ", c.Render())
+	}
+
+	if loaded, err := LoadConfig(filename); err != nil || loaded.Render() != strings.TrimPrefix(c.Render(), "persist-tun\n") {
+		t.Error("LoadConfig failed: ", err)
+	}
+}
+
+func TestLoadFileJSON(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "server.json")
+	json := `{"verb": "3", "ca": "C:\\Program Files\\ca.crt", "dev": "tun", "flags": ["persist-key"], "route": ["10.1.0.0 255.255.0.0"]}`
+	if err := ioutil.WriteFile(filename, []byte(json), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys are added in order, the same every time
+	expected := strings.Join([]string{
+		`ca "C:\\Program Files\\ca.crt"`,
+		"dev tun",
+		"persist-key",
+		"route 10.1.0.0 255.255.0.0",
+		"verb 3",
+		"",
+	}, "\n")
+	for i := 0; i < 5; i++ {
+		c := NewConfig()
+		if err := c.LoadFile(filename); err != nil {
+			t.Fatal(err)
+		}
+		if rendered := c.Render(); rendered != expected {
+			t.Fatalf("Invalid config:\n%s\nexpected:\n%s", rendered, expected)
+		}
+	}
+}
+
+func TestSetLiteral(t *testing.T) {
+	c := NewConfig()
+	c.Set("ca", `C:\keys\ca.crt`)
+	if values := c.Values("ca"); len(values) != 1 || !equalArgs(values[0], []string{`C:\keys\ca.crt`}) {
+		t.Error("The backslashes were not kept: ", values)
+	}
+
+	// A single argument is kept whole, even with spaces
+	c.Set("dh", "/etc/open vpn/dh.pem")
+	if values := c.Values("dh"); len(values) != 1 || !equalArgs(values[0], []string{"/etc/open vpn/dh.pem"}) {
+		t.Error("The path was split: ", values)
+	}
+	if !strings.Contains(c.Render(), `dh "/etc/open vpn/dh.pem"`) {
+		t.Error("The path was not quoted: ", c.Render())
+	}
+
+	// Options taking several arguments are still split
+	c.Set("keepalive", "10 120")
+	if values := c.Values("keepalive"); len(values) != 1 || !equalArgs(values[0], []string{"10", "120"}) {
+		t.Error("Invalid keepalive: ", values)
+	}
+
+	if err := c.SetQuoted("cert", `'C:\Program Files\cert.crt'`); err != nil {
+		t.Fatal(err)
+	}
+	if values := c.Values("cert"); len(values) != 1 || !equalArgs(values[0], []string{`C:\Program Files\cert.crt`}) {
+		t.Error("Invalid quoted value: ", values)
+	}
+	if err := c.SetQuoted("key", `"unterminated`); err == nil {
+		t.Error("Expected an error for an unterminated quote")
+	}
+}
+
+func TestProfile(t *testing.T) {
+	dir := t.TempDir()
+	files := profileFiles{}
+	for _, f := range []struct {
+		path *string
+		name string
+	}{{&files.ca, "ca.crt"}, {&files.cert, "client.crt"}, {&files.key, "client.key"}, {&files.ta, "ta.key"}} {
+		*f.path = filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(*f.path, []byte(f.name+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewConfig()
+	c.Flag("client")
+	c.Flag("tls-client")
+	c.set("ca", files.ca)
+	c.set("cert", files.cert)
+	c.set("key", files.key)
+	c.set("dh", "/etc/openvpn/dh.pem")
+	c.set("tls-auth", files.ta, "1")
+	c.Remote("vpn.example.com", 1194)
+	c.setManagementPath("/tmp/management.sock unix")
+
+	profile, err := files.profile(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Join([]string{
+		"client",
+		"tls-client",
+		"port 1194",
+		"remote vpn.example.com",
+		"key-direction 1",
+		"<ca>", "ca.crt", "</ca>",
+		"<cert>", "client.crt", "</cert>",
+		"<key>", "client.key", "</key>",
+		"<tls-auth>", "ta.key", "</tls-auth>",
+		"",
+	}, "\n")
+	if rendered := profile.Render(); rendered != expected {
+		t.Errorf("Invalid profile:\n%s\nexpected:\n%s", rendered, expected)
+	}
+
+	// tls-crypt and a key delivered separately
+	files.key = ""
+	files.tlsCrypt = true
+	if profile, err = files.profile(c); err != nil {
+		t.Fatal(err)
+	}
+	rendered := profile.Render()
+	if strings.Contains(rendered, "<key>") || strings.Contains(rendered, "key-direction") || !strings.Contains(rendered, "<tls-crypt>\nta.key\n</tls-crypt>") {
+		t.Error("Invalid tls-crypt profile: ", rendered)
+	}
+
+	files.ca = filepath.Join(dir, "missing.crt")
+	if _, err = files.profile(c); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func TestRepeatedDirectives(t *testing.T) {
+	c := NewConfig()
+	c.Set("mode", "server")
+	for i := 0; i < 30; i++ {
+		c.AddRoute("10.0."+strconv.Itoa(i)+".0", "255.255.255.0")
+		c.AddPush("route 10.0." + strconv.Itoa(i) + ".0 255.255.255.0")
+	}
+	c.AddPush(`dhcp-option DOMAIN "example com"`)
+	c.AddDirective("setenv", "FOO", "a b")
+
+	if routes := c.Values("route"); len(routes) != 30 || routes[29][0] != "10.0.29.0" {
+		t.Error("Invalid routes: ", routes)
+	}
+	if pushes := c.Values("push"); len(pushes) != 31 || pushes[0][0] != "route 10.0.0.0 255.255.255.0" {
+		t.Error("Invalid pushes: ", pushes)
+	}
+
+	c.RemoveRoute("10.0.0.0", "255.255.255.0")
+	c.RemovePush("route 10.0.1.0 255.255.255.0")
+	if routes := c.Values("route"); len(routes) != 29 || routes[0][0] != "10.0.1.0" {
+		t.Error("Route not removed: ", routes)
+	}
+	if pushes := c.Values("push"); len(pushes) != 30 || pushes[0][0] != "route 10.0.0.0 255.255.255.0" {
+		t.Error("Push not removed: ", pushes)
+	}
+
+	rendered := c.Render()
+	for _, line := range []string{
+		`push "dhcp-option DOMAIN \"example com\""`,
+		`setenv FOO "a b"`,
+		"route 10.0.29.0 255.255.255.0",
+	} {
+		if !strings.Contains(rendered, line+"\n") {
+			t.Error("Missing line: ", line)
+		}
+	}
+
+	// Remotes are tried in order, the first one is used to detect client mode
+	c.AddRemote("vpn1.example.com", 1194, "udp")
+	c.AddRemote("vpn2.example.com", 443, "tcp")
+	if c.remote != "vpn1.example.com" {
+		t.Error("Invalid remote: ", c.remote)
+	}
+	c.RemoveDirective("remote", "vpn1.example.com", "1194", "udp")
+	if c.remote != "vpn2.example.com" {
+		t.Error("Invalid remote after removal: ", c.remote)
+	}
+	c.Remove("push")
+	c.Remove("remote")
+	if len(c.Values("push")) != 0 || c.remote != "" {
+		t.Error("Options not removed: ", c.Render())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	// The shorthands and the example config are valid
+	for name, p := range map[string]*Process{
+		"static key server": NewStaticKeyServer("pre-shared.key", ""),
+		"static key client": NewStaticKeyClient("localhost", "pre-shared.key", ""),
+	} {
+		if _, err := p.config.Validate(); err != nil {
+			t.Error(name, ": ", err)
+		}
+	}
+
+	c := NewConfig()
+	if err := c.LoadFile("examples/sample-config-ssl-server.json"); err != nil {
+		t.Fatal(err)
+	}
+	c.IpPool("10.255.255.0/24")
+	if _, err := c.Validate(); err != nil {
+		t.Error("sample config: ", err)
+	}
+
+	c, err := ParseConfig(strings.NewReader(strings.Join([]string{
+		"client",
+		"dev tun",
+		"remote vpn.example.com 1194 udp",
+		"remote backup.example.com tcp",
+		"porte 1194",
+		"keepalive 10",
+		"verb loud",
+		"proto sctp",
+		"client-to-client",
+		"secret static.key",
+		"tls-auth ta.key 2",
+		"tls-crypt tc.key",
+		"ignore-unknown-option block-outside-dns-v2",
+		"block-outside-dns-v2",
+		"<connection>",
+		"remote backup.example.com 443 tcp",
+		"http-proxy-option VERSION 1.1",
+		"max-clients 10",
+		"</connection>",
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Strict = true
+	_, err = c.Validate()
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatal("Expected ConfigErrors, got: ", err)
+	}
+
+	expected := []string{
+		"remote: invalid argument 'tcp'",
+		"porte: unknown option",
+		"keepalive: expected 2 arguments, got 1",
+		"verb: invalid argument 'loud'",
+		"proto: invalid value 'sctp', expected one of " + strings.Join(protocols, ", "),
+		"client-to-client: can only be used by a server",
+		"secret: can't be used together with client",
+		"tls-auth: invalid argument '2'",
+		"tls-auth: can't be used together with tls-crypt",
+		"connection/max-clients: can only be used by a server",
+		"connection/max-clients: not allowed in a <connection> block",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("Invalid errors: ", err)
+	}
+	for i, e := range errs {
+		if e.Error() != expected[i] {
+			t.Errorf("Error %d is %q, expected %q", i, e.Error(), expected[i])
+		}
+	}
+
+	// Unknown options are only warned about unless Strict is set
+	c, err = ParseConfig(strings.NewReader(strings.Join([]string{
+		"client",
+		"remote vpn.example.com 1194",
+		"mlock",
+		"socket-flags TCP_NODELAY",
+		"client-nat snat 192.168.0.0 255.255.255.0 10.64.0.0",
+		"verify-hash AB:CD SHA256",
+		"some-future-option 1",
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Validate(); err != nil {
+		t.Error("Unknown options should not fail without Strict: ", err)
+	}
+	c.Strict = true
+	if _, err := c.Validate(); err == nil || err.Error() != "openvpn: invalid config: some-future-option: unknown option" {
+		t.Error("Expected only some-future-option to fail, got: ", err)
+	}
+}
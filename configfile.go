@@ -0,0 +1,122 @@
+package openvpn
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// Render returns the config in the native openvpn config file format, one
+// directive per line in the order they were added. Inline and <connection>
+// blocks are written as blocks.
+func (c *Config) Render() string {
+	var buf bytes.Buffer
+
+	for _, d := range c.directives {
+		switch {
+		case d.block != nil:
+			buf.WriteString("<" + d.name + ">\n")
+			buf.WriteString(d.block.Render())
+			buf.WriteString("</" + d.name + ">\n")
+		case d.inline != "":
+			buf.WriteString("<" + d.name + ">\n")
+			buf.WriteString(d.inline)
+			if !strings.HasSuffix(d.inline, "\n") {
+				buf.WriteString("\n")
+			}
+			buf.WriteString("</" + d.name + ">\n")
+		default:
+			buf.WriteString(d.name)
+			for _, arg := range d.args {
+				buf.WriteString(" ")
+				buf.WriteString(quoteArg(arg))
+			}
+			buf.WriteString("\n")
+		}
+	}
+	return buf.String()
+}
+
+// WriteFile renders the config to a file only readable by the owner, as it
+// may contain secrets
+func (c *Config) WriteFile(filename string) error {
+	return ioutil.WriteFile(filename, []byte(c.Render()), 0600)
+}
+
+// quoteArg quotes an argument the way the openvpn config parser expects
+func quoteArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\r\n\"'\\") && arg[0] != '#' && arg[0] != ';' {
+		return arg
+	}
+
+	arg = strings.Replace(arg, "\\", "\\\\", -1)
+	arg = strings.Replace(arg, "\"", "\\\"", -1)
+	return "\"" + arg + "\""
+}
+
+// splitArgs splits a config line into arguments like openvpn does. Arguments
+// are separated by whitespace and can be quoted with double or single quotes.
+// A backslash escapes the next character, except within single quotes. A #
+// or ; between arguments starts a comment.
+func splitArgs(line string) ([]string, error) { // {{{
+	args := make([]string, 0)
+
+	var arg bytes.Buffer
+	inArg := false
+	var quote byte // The quote we are within, if any
+	escaped := false
+
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+
+		switch {
+		case escaped:
+			arg.WriteByte(ch)
+			escaped = false
+		case ch == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			} else {
+				arg.WriteByte(ch)
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+			inArg = true
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case !inArg && (ch == '#' || ch == ';'):
+			i = len(line) // Comment
+		default:
+			arg.WriteByte(ch)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("missing closing quote")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+} // }}}
+
+func equalArgs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,176 @@
+package openvpn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Directives that can be given inline, as <name>...</name> blocks
+var inlineDirectives = map[string]bool{
+	"ca":                   true,
+	"cert":                 true,
+	"extra-certs":          true,
+	"key":                  true,
+	"pkcs12":               true,
+	"dh":                   true,
+	"tls-auth":             true,
+	"tls-crypt":            true,
+	"tls-crypt-v2":         true,
+	"secret":               true,
+	"crl-verify":           true,
+	"auth-user-pass":       true,
+	"http-proxy-user-pass": true,
+	"peer-fingerprint":     true,
+}
+
+// LoadConfig reads a native openvpn config file (.conf or .ovpn)
+func LoadConfig(filename string) (*Config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := ParseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return c, nil
+}
+
+// ParseConfig reads the native openvpn config syntax, with comments, quoting,
+// repeated directives, inline <ca>, <cert>, <key>, <tls-auth>... blocks and
+// <connection> blocks
+func ParseConfig(r io.Reader) (*Config, error) {
+	c := NewConfig()
+	p := &configParser{scanner: bufio.NewScanner(r)}
+	p.scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	if err := p.parse(c, ""); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type configParser struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (p *configParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+// parse adds the directives to c until the end, or until </end> for a
+// <connection> block
+func (p *configParser) parse(c *Config, end string) error { // {{{
+	for p.scanner.Scan() {
+		p.line++
+		line := strings.TrimSpace(p.scanner.Text())
+		if p.line == 1 {
+			line = strings.TrimPrefix(line, "\ufeff") // Byte order mark
+		}
+
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+			continue
+		case strings.HasPrefix(line, "</"):
+			if end == "" || line != "</"+end+">" {
+				return p.errorf("unexpected %s", line)
+			}
+			c.Refresh()
+			return nil
+		case strings.HasPrefix(line, "<") && strings.HasSuffix(line, ">"):
+			name := line[1 : len(line)-1]
+
+			if name == "connection" {
+				if end != "" {
+					return p.errorf("<connection> blocks can't be nested")
+				}
+
+				block := NewConfig()
+				if err := p.parse(block, name); err != nil {
+					return err
+				}
+				c.directives = append(c.directives, directive{name: name, block: block})
+				continue
+			}
+
+			if !inlineDirectives[name] {
+				return p.errorf("%s can't be given inline", name)
+			}
+
+			inline, err := p.inline(name)
+			if err != nil {
+				return err
+			}
+			c.directives = append(c.directives, directive{name: name, inline: inline})
+		default:
+			args, err := splitArgs(line)
+			if err != nil {
+				return p.errorf("%s", err)
+			}
+			if len(args) == 0 {
+				continue
+			}
+
+			name := strings.TrimPrefix(args[0], "--")
+			c.directives = append(c.directives, directive{name: name, args: args[1:]})
+		}
+	}
+
+	if err := p.scanner.Err(); err != nil {
+		return err
+	}
+	if end != "" {
+		return p.errorf("missing </%s>", end)
+	}
+
+	c.Refresh()
+	return nil
+} // }}}
+
+// inline reads the content of an inline block, up to </name>
+func (p *configParser) inline(name string) (string, error) {
+	var content strings.Builder
+
+	for p.scanner.Scan() {
+		p.line++
+		line := p.scanner.Text()
+
+		if strings.TrimSpace(line) == "</"+name+">" {
+			return content.String(), nil
+		}
+		content.WriteString(strings.TrimRight(line, "\r"))
+		content.WriteString("\n")
+	}
+
+	if err := p.scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", p.errorf("missing </%s>", name)
+}
+
+// isJSON tells if the file is in the JSON format read by Config.LoadFile
+func isJSON(r *bufio.Reader) bool {
+	for {
+		ch, _, err := r.ReadRune()
+		if err != nil {
+			return false
+		}
+		if !unicode.IsSpace(ch) && ch != '\ufeff' {
+			r.UnreadRune()
+			return ch == '{'
+		}
+	}
+}
+
+// merge adds the directives from another config after ours
+func (c *Config) merge(other *Config) {
+	c.directives = append(c.directives, other.directives...)
+	c.Refresh()
+}
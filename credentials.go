@@ -0,0 +1,94 @@
+package openvpn
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// CredentialRequest is sent to the CredentialProvider when openvpn asks for a
+// password (>PASSWORD:Need ...).
+type CredentialRequest struct {
+	Realm        string     // "Auth" for auth-user-pass, "Private Key" for encrypted keys or "HTTP Proxy"
+	NeedUsername bool       // False when only a password or passphrase is requested
+	Challenge    *Challenge // Set when the client is configured with "static-challenge"
+}
+
+// CredentialProvider supplies the username, password or passphrase openvpn
+// needs when running as a client. Setting Process.CredentialProvider enables
+// management-query-passwords, so credentials are never read from disk.
+type CredentialProvider interface {
+	Credentials(req *CredentialRequest) (username, password string, err error)
+}
+
+// CredentialsFunc allows a plain function to be used as a CredentialProvider
+type CredentialsFunc func(req *CredentialRequest) (username, password string, err error)
+
+func (f CredentialsFunc) Credentials(req *CredentialRequest) (username, password string, err error) {
+	return f(req)
+}
+
+func (m *Management) credentials(req *CredentialRequest) { // {{{
+	if m.Conn.CredentialProvider == nil {
+		log.Error("Management: openvpn needs '", req.Realm, "' credentials, but no CredentialProvider is set")
+		return
+	}
+
+	var username, password, response string
+	var err error
+	var ch *Challenge
+
+	if req.Realm == "Auth" {
+		ch = m.takeChallenge()
+	}
+
+	if ch != nil {
+		// Answer the dynamic challenge sent after the last attempt
+		if response, err = m.respond(ch); err == nil {
+			err = m.sendCredentials(req, ch.Username, "CRV1::"+ch.StateID+"::"+response)
+		}
+	} else if username, password, err = m.Conn.CredentialProvider.Credentials(req); err == nil {
+		if req.Challenge != nil {
+			if response, err = m.respond(req.Challenge); err == nil {
+				password = "SCRV1:" + base64.StdEncoding.EncodeToString([]byte(password)) + ":" + base64.StdEncoding.EncodeToString([]byte(response))
+			}
+		}
+		if err == nil {
+			err = m.sendCredentials(req, username, password)
+		}
+	}
+
+	if err != nil {
+		log.Error("Management: failed to answer '", req.Realm, "' credentials: ", err)
+	}
+} // }}}
+
+func (m *Management) sendCredentials(req *CredentialRequest, username, password string) error { // {{{
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	if req.NeedUsername {
+		if username == "" {
+			return errors.New("empty username")
+		}
+		if _, err := m.Command(ctx, "username "+quote(req.Realm)+" "+quote(username)); err != nil {
+			return err
+		}
+	}
+
+	_, err := m.Command(ctx, "password "+quote(req.Realm)+" "+quote(password))
+	return err
+} // }}}
+
+// parseCredentialRequest decodes the text following >PASSWORD:Need
+func parseCredentialRequest(realm, what string) *CredentialRequest {
+	return &CredentialRequest{
+		Realm:        realm,
+		NeedUsername: strings.HasPrefix(what, "username/password"),
+		Challenge:    parseStaticChallenge(what),
+	}
+}
@@ -1,6 +1,183 @@
 package openvpn
 
+import (
+	"strconv"
+	"time"
+)
+
+// Event is the legacy untyped event delivered on Process.Events
 type Event struct {
 	Name string
 	Args []string
 }
+
+// TypedEvent is implemented by all events delivered on Process.TypedEvents.
+// Use a type switch to find out what happened:
+//
+//	switch e := event.(type) {
+//	case *openvpn.StateChanged:
+//		log.Println("State: ", e.State)
+//	case *openvpn.ClientConnected:
+//		log.Println("Client connected: ", e.CommonName)
+//	}
+type TypedEvent interface {
+	Header() EventHeader
+	stamp(seq uint64, t time.Time)
+}
+
+// EventHeader is embedded in every typed event
+type EventHeader struct {
+	Seq  uint64    // Sequence number, increasing by one for each event from a process
+	Time time.Time // When the event was registered by the library
+}
+
+func (h *EventHeader) Header() EventHeader {
+	return *h
+}
+func (h *EventHeader) stamp(seq uint64, t time.Time) {
+	h.Seq = seq
+	h.Time = t
+}
+
+// StateChanged is sent when openvpn reports a new state (>STATE:)
+type StateChanged struct {
+	EventHeader
+	Since       time.Time // Timestamp reported by openvpn
+	State       string    // CONNECTING, WAIT, AUTH, GET_CONFIG, ASSIGN_IP, ADD_ROUTES, CONNECTED, RECONNECTING or EXITING
+	Description string
+	LocalIP     string
+	RemoteIP    string
+}
+
+// ProcessStopped is sent when openvpn has been stopped by Process.Stop
+type ProcessStopped struct {
+	EventHeader
+	Method StopMethod // The step of the shutdown that ended the process
+	Err    error      // As returned from exec.Cmd.Wait
+}
+
+// Restarting is sent by the Supervisor before openvpn is restarted
+type Restarting struct {
+	EventHeader
+	Attempt int           // Number of failures in a row
+	Delay   time.Duration // Backoff before the restart
+	Reason  string        // Why openvpn stopped
+}
+
+// GaveUp is sent when the Supervisor stops restarting openvpn
+type GaveUp struct {
+	EventHeader
+	Reason string
+	Fatal  bool // Openvpn failed with an error that a restart wont fix
+}
+
+// ClientConnected is sent when a new client is authenticated and added to
+// Process.Clients, clients that are denied are never reported
+type ClientConnected struct {
+	EventHeader
+	ClientID   string
+	CommonName string
+}
+
+// ClientDisconnected is sent when a client is removed from Process.Clients
+type ClientDisconnected struct {
+	EventHeader
+	ClientID   string
+	CommonName string
+}
+
+// ClientKilled is sent after ClientDisconnected when the client was killed
+// with Process.KillClient, KillCommonName or KillAddress
+type ClientKilled struct {
+	EventHeader
+	ClientID   string
+	CommonName string
+	Mode       KillMode
+}
+
+// ClientAddressLearned is sent when a virtual address or subnet is associated with a client (>CLIENT:ADDRESS)
+type ClientAddressLearned struct {
+	EventHeader
+	ClientID string
+	Address  string
+	Primary  bool
+}
+
+// ByteCount reports the amount of traffic that have passed the tunnel. In
+// server mode ClientID identifies the client, in client mode it is empty.
+type ByteCount struct {
+	EventHeader
+	ClientID string
+	BytesIn  uint64
+	BytesOut uint64
+	RateIn   float64 // Bytes per second
+	RateOut  float64 // Bytes per second
+}
+
+// LogLine is a log message from openvpn (>LOG:)
+type LogLine struct {
+	EventHeader
+	Since   time.Time // Timestamp reported by openvpn
+	Flags   string    // I, F, N, W or D
+	Message string
+}
+
+// Info is an informational message from openvpn, such as the welcome message (>INFO:)
+type Info struct {
+	EventHeader
+	Message string
+}
+
+// Hold is sent when openvpn is waiting for "hold release" (>HOLD:)
+type Hold struct {
+	EventHeader
+	Message string
+}
+
+// Fatal is sent just before openvpn exits because of an error (>FATAL:)
+type Fatal struct {
+	EventHeader
+	Message string
+}
+
+// AuthFailed is sent when openvpn reports that the credentials was rejected
+// (>PASSWORD:Verification Failed). Challenge is set when the server asked for
+// a dynamic challenge instead, it is answered through the ChallengeResponder
+// when openvpn asks for credentials again.
+type AuthFailed struct {
+	EventHeader
+	Realm     string
+	Message   string
+	Challenge *Challenge
+}
+
+// NeedOk is sent when openvpn needs the user to do something, like inserting a token (>NEED-OK:)
+type NeedOk struct {
+	EventHeader
+	Name    string
+	Message string
+}
+
+// NeedStr is sent when openvpn needs a string from the user (>NEED-STR:)
+type NeedStr struct {
+	EventHeader
+	Name    string
+	Message string
+}
+
+// EchoMessage is a message pushed with "echo" from the server (>ECHO:),
+// delivered on both Process.Echo and Process.TypedEvents
+type EchoMessage struct {
+	EventHeader
+	Since   time.Time // Timestamp reported by openvpn
+	Message string
+}
+
+// parseUnixTime decodes the unix timestamps used in real-time notifications
+func parseUnixTime(s string) time.Time {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
@@ -0,0 +1,102 @@
+package openvpn
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// Number of output lines kept from stdout and stderr for ExitError
+const outputTailLines = 50
+
+// ExitError describes why openvpn exited. It is returned from Process.Wait
+// and Process.ExitStatus.
+type ExitError struct {
+	Code   int      // The exit code, -1 when killed by a signal
+	Signal string   // The signal that killed openvpn, if any
+	Fatal  string   // The last >FATAL: message or options error
+	Stdout []string // The last lines written to stdout
+	Stderr []string // The last lines written to stderr
+	Err    error    // As returned from exec.Cmd.Wait
+}
+
+func (e *ExitError) Error() string {
+	msg := "openvpn: exit status " + strconv.Itoa(e.Code)
+	if e.Signal != "" {
+		msg = "openvpn: killed by signal " + e.Signal
+	} else if e.Err != nil && e.Code == -1 {
+		msg = "openvpn: " + e.Err.Error()
+	}
+
+	if e.Fatal != "" {
+		msg += ": " + e.Fatal
+	}
+	return msg
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// Wait blocks until openvpn exits, and returns the same as ExitStatus
+func (p *Process) Wait() error {
+	p.lock.Lock()
+	stopped := p.Stopped
+	p.lock.Unlock()
+
+	if stopped == nil {
+		return ErrNotRunning
+	}
+	<-stopped
+
+	return p.ExitStatus()
+}
+
+// ExitStatus returns an *ExitError when openvpn has exited with an error, and
+// nil while it is running or after a clean exit
+func (p *Process) ExitStatus() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.exitErr == nil {
+		return nil
+	}
+	return p.exitErr
+}
+
+// newExitError builds the ExitError from the result of exec.Cmd.Wait, the
+// caller holds the lock
+func (p *Process) newExitError(err error) *ExitError {
+	if err == nil && p.fatal == "" {
+		return nil
+	}
+
+	e := &ExitError{
+		Code:   0,
+		Fatal:  p.fatal,
+		Stdout: append([]string(nil), p.stdoutTail...),
+		Stderr: append([]string(nil), p.stderrTail...),
+		Err:    err,
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		e.Code = exitErr.ExitCode()
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			e.Signal = status.Signal().String()
+		}
+	} else if err != nil {
+		e.Code = -1 // Failed to start or wait for openvpn
+	}
+	return e
+}
+
+// addOutput keeps the last lines of stdout or stderr
+func (p *Process) addOutput(tail *[]string, line string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	*tail = append(*tail, line)
+	if len(*tail) > outputTailLines {
+		*tail = (*tail)[1:]
+	}
+}
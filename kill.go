@@ -0,0 +1,80 @@
+package openvpn
+
+import "context"
+
+// KillMode is the message sent to a client killed with KillClient
+type KillMode string
+
+const (
+	KillDefault KillMode = ""        // Let openvpn decide, the client restarts
+	KillRestart KillMode = "RESTART" // The client reconnects
+	KillHalt    KillMode = "HALT"    // The client exits and does not reconnect
+)
+
+// KillClient disconnects the session with the client ID (CID), using
+// "client-kill". A ClientKilled event is sent when the disconnect is observed.
+func (p *Process) KillClient(ctx context.Context, cid string, mode KillMode) (Response, error) {
+	cmd := "client-kill " + cid
+	if mode != KillDefault {
+		cmd += " " + string(mode)
+	}
+
+	return p.kill(ctx, cmd, mode, func(c *Client) bool {
+		return c.ID == cid
+	})
+}
+
+// KillCommonName disconnects all sessions using the common name, "kill cn"
+func (p *Process) KillCommonName(ctx context.Context, cn string) (Response, error) {
+	return p.kill(ctx, "kill "+quote(cn), KillDefault, func(c *Client) bool {
+		return c.CommonName == cn
+	})
+}
+
+// KillAddress disconnects the session connecting from the real address, "kill IP:port"
+func (p *Process) KillAddress(ctx context.Context, addr string) (Response, error) {
+	return p.kill(ctx, "kill "+addr, KillDefault, func(c *Client) bool {
+		return c.PublicIP == addr
+	})
+}
+
+// kill marks the matching clients so the disconnect can be reported, and
+// sends the command
+func (p *Process) kill(ctx context.Context, cmd string, mode KillMode, match func(c *Client) bool) (Response, error) { // {{{
+	p.clientLock.Lock()
+	marked := make([]*Client, 0)
+	for _, c := range p.Clients {
+		if match(c) && c.killed == nil {
+			c.killed = &mode
+			marked = append(marked, c)
+		}
+	}
+	p.clientLock.Unlock()
+
+	resp, err := p.Command(ctx, cmd)
+	if err != nil {
+		p.clientLock.Lock()
+		for _, c := range marked {
+			c.killed = nil
+		}
+		p.clientLock.Unlock()
+	}
+	return resp, err
+} // }}}
+
+// clientRemoved reports a removed client, the caller holds clientLock
+func (p *Process) clientRemoved(c *Client) {
+	p.Fire("client removed", c.CommonName, c.ID)
+	p.emit(&ClientDisconnected{
+		ClientID:   c.ID,
+		CommonName: c.CommonName,
+	})
+
+	if c.killed != nil {
+		p.emit(&ClientKilled{
+			ClientID:   c.ID,
+			CommonName: c.CommonName,
+			Mode:       *c.killed,
+		})
+	}
+}
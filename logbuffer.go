@@ -0,0 +1,237 @@
+package openvpn
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLogBufferSize is the number of log records kept by a process
+const defaultLogBufferSize = 1000
+
+// switchOverlap is how many of the last records are checked for a line that
+// was read from stdout before the log notifications were turned on
+const switchOverlap = 50
+
+// LogLevel is the flag openvpn gives each log message
+type LogLevel string
+
+const (
+	LogInfo     LogLevel = "I"
+	LogFatal    LogLevel = "F"
+	LogNonFatal LogLevel = "N"
+	LogWarning  LogLevel = "W"
+	LogDebug    LogLevel = "D"
+)
+
+// LogRecord is a log message from openvpn, received on the management
+// interface (>LOG:) or read from stdout and stderr
+type LogRecord struct {
+	Time    time.Time
+	Level   LogLevel
+	Message string
+	Source  string // "management", "stdout" or "stderr"
+}
+
+// LogBuffer keeps the last log records from openvpn and passes new records
+// on to the subscribers
+type LogBuffer struct {
+	records []LogRecord
+	next    int // Where the next record goes when the buffer is full
+	size    int
+
+	subscribers map[*LogSubscription]bool
+	lock        sync.Mutex
+}
+
+// LogSubscription receives new log records on C. A subscriber that doesnt keep
+// up loses records, it never blocks openvpn.
+type LogSubscription struct {
+	C <-chan LogRecord
+
+	c       chan LogRecord
+	dropped int
+	buffer  *LogBuffer
+}
+
+func NewLogBuffer(size int) *LogBuffer {
+	return &LogBuffer{
+		records:     make([]LogRecord, 0),
+		size:        size,
+		subscribers: make(map[*LogSubscription]bool, 0),
+	}
+}
+
+// Logs returns the log buffer of the process
+func (p *Process) Logs() *LogBuffer {
+	return p.logs
+}
+
+// Records returns the buffered records, oldest first
+func (b *LogBuffer) Records() []LogRecord {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	records := make([]LogRecord, 0, len(b.records))
+	records = append(records, b.records[b.next:]...)
+	return append(records, b.records[:b.next]...)
+}
+
+// Subscribe starts delivering new records, buffering up to size records for
+// a slow reader
+func (b *LogBuffer) Subscribe(size int) *LogSubscription {
+	c := make(chan LogRecord, size)
+	s := &LogSubscription{
+		C:      c,
+		c:      c,
+		buffer: b,
+	}
+
+	b.lock.Lock()
+	b.subscribers[s] = true
+	b.lock.Unlock()
+
+	return s
+}
+
+// Close stops the subscription and closes C
+func (s *LogSubscription) Close() {
+	s.buffer.lock.Lock()
+	defer s.buffer.lock.Unlock()
+
+	if s.buffer.subscribers[s] {
+		delete(s.buffer.subscribers, s)
+		close(s.c)
+	}
+}
+
+// Dropped returns the number of records lost because C was full
+func (s *LogSubscription) Dropped() int {
+	s.buffer.lock.Lock()
+	defer s.buffer.lock.Unlock()
+
+	return s.dropped
+}
+
+func (b *LogBuffer) add(r LogRecord) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.store(r)
+}
+
+// addNotification adds a record received as a >LOG: notification. Lines
+// logged while switching from stdout to the management interface are read
+// from both, the copy from stdout is kept.
+func (b *LogBuffer) addNotification(r LogRecord) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	key := r.key()
+	for i := 1; i <= len(b.records) && i <= switchOverlap; i++ {
+		prev := b.records[(b.next-i+len(b.records))%len(b.records)]
+		if prev.Source != r.Source && prev.key() == key {
+			return
+		}
+	}
+
+	b.store(r)
+}
+
+// addHistory adds the records returned by "log all", skipping those
+// already read from stdout
+func (b *LogBuffer) addHistory(records []LogRecord) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	seen := make(map[string]bool, len(b.records))
+	for _, r := range b.records {
+		seen[r.key()] = true
+	}
+
+	for _, r := range records {
+		if !seen[r.key()] {
+			b.store(r)
+		}
+	}
+}
+
+// store adds a record and passes it on, the caller holds the lock
+func (b *LogBuffer) store(r LogRecord) {
+	if b.size > 0 {
+		if len(b.records) < b.size {
+			b.records = append(b.records, r)
+		} else {
+			b.records[b.next] = r
+			b.next = (b.next + 1) % b.size
+		}
+	}
+
+	for s := range b.subscribers {
+		select {
+		case s.c <- r:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+func (r LogRecord) key() string {
+	return strconv.FormatInt(r.Time.Unix(), 10) + " " + r.Message
+}
+
+// parseLogRecord decodes a >LOG: notification or a line from "log all",
+// {TIME},{FLAGS},{MESSAGE}
+func parseLogRecord(line string) (LogRecord, bool) {
+	fields := strings.SplitN(line, ",", 3)
+	if len(fields) < 3 {
+		return LogRecord{}, false
+	}
+
+	level := LogInfo
+	if len(fields[1]) > 0 {
+		level = LogLevel(fields[1][:1])
+	}
+	return LogRecord{
+		Time:    parseUnixTime(fields[0]),
+		Level:   level,
+		Message: fields[2],
+		Source:  "management",
+	}, true
+}
+
+// Layouts of the timestamp openvpn puts in front of the lines it writes to stdout
+var outputTimeLayouts = []string{
+	"2006-01-02 15:04:05 ", // 2.5 and later
+	statusTimeLayout + " ",
+}
+
+// parseOutputLine decodes a line written by openvpn to stdout or stderr
+func parseOutputLine(line, source string) LogRecord {
+	r := LogRecord{
+		Time:    time.Now(),
+		Level:   LogInfo,
+		Message: line,
+		Source:  source,
+	}
+
+	for _, layout := range outputTimeLayouts {
+		if len(line) < len(layout) {
+			continue
+		}
+		if t, err := time.ParseInLocation(layout, line[:len(layout)], time.Local); err == nil {
+			r.Time = t
+			r.Message = line[len(layout):]
+			break
+		}
+	}
+
+	switch {
+	case isFatal(r.Message), strings.Contains(r.Message, "Exiting due to fatal error"):
+		r.Level = LogFatal
+	case strings.Contains(r.Message, "WARNING"):
+		r.Level = LogWarning
+	}
+	return r
+}
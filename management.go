@@ -1,22 +1,55 @@
 package openvpn
 
-import "sync"
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
 
 type Management struct {
 	Conn            *Process
 	ManagementRead  chan string `json:"-"`
 	ManagementWrite chan string `json:"-"`
 
-	Path string
+	Path      string
+	Password  string    // Required from openvpn through a pw-file, or sent to an attached openvpn
+	Transport Transport // How openvpn connects to us, defaults to a unix socket in the RuntimeDir (tcp on windows)
+
+	passwordFile string
+	listener     net.Listener // Open between Start and Shutdown
+	directive    string       // The arguments for the "management" option, returned by Start
+
+	events chan *message // Notifications waiting for the router
 
-	events chan []string
+	// Deferred authentications waiting for an answer, by "CID KID"
+	auths    map[string]*PendingAuth
+	authLock sync.Mutex
 
-	currentClient string
-	clientEnv     map[string]string
+	// The active management connection and the command waiting for its reply
+	conn     net.Conn
+	pending  *pendingCommand
+	commands chan bool // Holds a token while a command is in flight
+	lock     sync.Mutex
+
+	// The last dynamic challenge received, answered when openvpn asks for credentials again
+	challenge *Challenge
+
+	// Set when the log is received through the management interface instead of stdout
+	logging bool
 
-	buffer    []byte
 	waitGroup sync.WaitGroup
-	shutdown  chan bool
+	shutdown  chan bool // Closed by Shutdown, replaced when started again
 }
 
 func NewManagement(conn *Process) *Management {
@@ -25,10 +58,900 @@ func NewManagement(conn *Process) *Management {
 		ManagementRead:  make(chan string),
 		ManagementWrite: make(chan string),
 
-		events: make(chan []string),
+		events: make(chan *message, 100),
+
+		commands: make(chan bool, 1),
+
+		auths:    make(map[string]*PendingAuth, 0),
+		shutdown: make(chan bool),
+	}
+}
+
+// Start opens the management interface that openvpn will connect to, and
+// returns the arguments for the "management" option. When it is already open
+// the same arguments are returned, so openvpn can be started again.
+func (m *Management) Start() (directive string, err error) { // {{{
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.listener != nil {
+		return m.directive, nil
+	}
+
+	// Started again after a shutdown
+	select {
+	case <-m.shutdown:
+		m.shutdown = make(chan bool)
+	default:
+	}
+	shutdown := m.shutdown
+
+	if m.Transport == nil {
+		m.Transport = defaultTransport()
+	}
+
+	// Open the socket
+	l, err := m.Transport.Listen()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	m.Path = l.Addr().String()
+
+	log.Info("Management start: " + l.Addr().Network() + ":" + m.Path)
+
+	// Openvpn reads the password from a file
+	if m.Password != "" {
+		if m.passwordFile, err = writePasswordFile(m.Password); err != nil {
+			l.Close()
+			return
+		}
+	}
+
+	m.listener = l
+	m.directive = m.Transport.Directive(l, m.passwordFile)
+
+	// Wait for connections
+	m.waitGroup.Add(1)
+	go func() {
+		defer m.waitGroup.Done()
+
+		for {
+			fd, err := l.Accept()
+			if err != nil {
+				select {
+				case <-shutdown:
+					log.Info("Management: closed")
+				default:
+					log.Critical("accept error:", err)
+				}
+				return
+			}
+			log.Info("Management: openvpn management interface have connected")
+
+			go m.server(fd)
+		}
+	}()
+
+	return m.directive, nil
+} // }}}
+
+// Shutdown closes the management interface and removes the password file
+func (m *Management) Shutdown() {
+	log.Info("Management: shutdown")
+
+	m.lock.Lock()
+	select {
+	case <-m.shutdown:
+	default:
+		close(m.shutdown)
+	}
+	if m.listener != nil {
+		m.listener.Close()
+		m.listener = nil
+	}
+	if m.passwordFile != "" {
+		os.Remove(m.passwordFile)
+		m.passwordFile = ""
+	}
+	m.lock.Unlock()
+
+	m.waitGroup.Wait()
+	log.Info("Management: shutdown done")
+}
+
+// Dial connects to the management interface of an already running openvpn,
+// started with ex "management 127.0.0.1 7505" or "management /run/openvpn.sock unix".
+// The network is "tcp" or "unix".
+func (m *Management) Dial(network, address string) error { // {{{
+	log.Info("Management dial: " + network + ":" + address)
+
+	c, err := net.Dial(network, address)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(c)
+	if m.Password != "" {
+		if err := m.login(c, reader); err != nil {
+			c.Close()
+			return err
+		}
+	}
+
+	// Wait for shutdown
+	m.lock.Lock()
+	shutdown := m.shutdown
+	m.lock.Unlock()
+	go func() {
+		<-shutdown
+		c.Close()
+	}()
+
+	m.connected(c)
+	m.waitGroup.Add(1)
+	go func() {
+		defer m.waitGroup.Done()
+		m.serve(c, reader)
+		log.Info("Management: connection to ", address, " closed")
+	}()
+
+	// A running openvpn is not waiting in hold, so ask for the notifications right away
+	go m.notifications()
+
+	return nil
+} // }}}
+
+// login answers the ENTER PASSWORD: prompt sent by openvpn when the management
+// interface is protected by a password file
+func (m *Management) login(c net.Conn, reader *bufio.Reader) error { // {{{
+	c.SetReadDeadline(time.Now().Add(time.Second * 10))
+	defer c.SetReadDeadline(time.Time{})
+
+	prompt, err := reader.ReadString(':')
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(prompt, "ENTER PASSWORD:") {
+		return errors.New("openvpn: expected a password prompt, got " + strings.TrimSpace(prompt))
+	}
+
+	if _, err := c.Write([]byte(m.Password + "\n")); err != nil {
+		return err
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(strings.TrimSpace(line), "SUCCESS:") {
+		return errors.New("openvpn: management password was rejected: " + strings.TrimSpace(line))
+	}
+	return nil
+} // }}}
+
+// clientMode reports if openvpn is known to be running as a client. The mode of
+// an attached openvpn is unknown until the first status reply is received.
+func (m *Management) clientMode() bool {
+	return m.Conn.config != nil && m.Conn.config.remote != ""
+}
+
+// server handles a connection from openvpn to our management socket
+func (m *Management) server(c net.Conn) { // {{{
+	reader := bufio.NewReader(c)
+
+	// Answer the ENTER PASSWORD: prompt before anything else
+	if m.Password != "" {
+		if err := m.login(c, reader); err != nil {
+			log.Error("Management: ", err)
+			c.Close()
+			return
+		}
+	}
+
+	m.serve(c, reader)
+} // }}}
+
+func (m *Management) serve(c net.Conn, reader *bufio.Reader) { // {{{
+	m.connected(c)
+	defer m.disconnected(c)
+
+	closed := make(chan bool)
+	defer close(closed)
+
+	go func() {
+		if m.clientMode() {
+			log.Info("Management started in CLIENT mode")
+			return
+		}
+
+		log.Info("Management started in SERVER mode")
+		for {
+			select {
+			case <-time.After(time.Second * 1):
+			case <-closed:
+				return
+			}
+
+			if !m.status() {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case msg := <-m.events:
+				m.route(msg)
+			case <-closed:
+				return
+			}
+		}
+	}()
+
+	p := newParser()
+	for {
+		line, truncated, err := readLine(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Error("Management: failed to read: ", err)
+			}
+			return
+		}
+		if truncated {
+			if len(line) > 80 {
+				line = line[:80]
+			}
+			log.Error("Management: throwing away a line longer than ", maxLineLength, " bytes: ", line, "...")
+			continue
+		}
+
+		msg := p.feed(line)
+		if msg == nil {
+			continue
+		}
+
+		// Replies to commands are handed to the caller of Command
+		if msg.kind == "" && m.reply(msg) {
+			continue
+		}
+
+		m.deliver(msg)
+	}
+} // }}}
+
+// deliver hands a message over to the router
+func (m *Management) deliver(msg *message) { // {{{
+	select {
+	case m.events <- msg:
+	case <-time.After(time.Second):
+		log.Errorf("Failed to transport message (%p): %s %s", m.events, msg.kind, msg.payload)
+	}
+} // }}}
+
+// status requests the client list and hands it over to the router. It
+// returns false if openvpn turns out to be running as a client.
+func (m *Management) status() bool { // {{{
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	resp, err := m.Command(ctx, "status 3")
+	if err != nil {
+		log.Warn("Management: status failed: ", err)
+		return true
+	}
+
+	if len(resp.Lines) > 0 && resp.Lines[0] == "OpenVPN STATISTICS" {
+		log.Info("Management: openvpn is running in CLIENT mode, stopped polling the client list")
+		return false
+	}
+
+	m.deliver(&message{lines: resp.Lines})
+	return true
+} // }}}
+
+// notifications enables the real-time notifications we need
+func (m *Management) notifications() { // {{{
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	cmds := []string{"echo on", "state on"}
+	if interval := int(m.Conn.BytecountInterval / time.Second); interval > 0 {
+		cmds = append(cmds, "bytecount "+strconv.Itoa(interval))
+	}
+
+	for _, cmd := range cmds {
+		if _, err := m.Command(ctx, cmd); err != nil {
+			log.Error("Management: ", err)
+		}
+	}
+
+	m.logHistory(ctx)
+} // }}}
+
+// logHistory fetches the log openvpn has kept so far and enables real-time
+// log notifications, replacing the log read from stdout. "log on all" would
+// get two replies, so the history and the notifications are asked for
+// separately. Stdout is still read in between, so nothing is lost, and the
+// lines read from both stdout and the notifications before the switch are
+// only kept once.
+func (m *Management) logHistory(ctx context.Context) { // {{{
+	resp, err := m.Command(ctx, "log all")
+	if err != nil {
+		log.Error("Management: ", err)
+		return
+	}
+	if _, err := m.Command(ctx, "log on"); err != nil {
+		log.Error("Management: ", err)
+		return
+	}
+
+	records := make([]LogRecord, 0, len(resp.Lines))
+	for _, line := range resp.Lines {
+		if r, ok := parseLogRecord(line); ok {
+			records = append(records, r)
+		}
+	}
+	m.Conn.logs.addHistory(records)
+
+	m.lock.Lock()
+	m.logging = true
+	m.lock.Unlock()
+} // }}}
+
+// isLogging tells if the log is received through the management interface
+func (m *Management) isLogging() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.logging
+}
+
+// holdRelease enables the notifications we need and lets openvpn continue
+func (m *Management) holdRelease() { // {{{
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	m.notifications()
+
+	if _, err := m.Command(ctx, "hold release"); err != nil {
+		log.Error("Management: ", err)
+	}
+} // }}}
+
+func (m *Management) route(msg *message) { // {{{
+	switch msg.kind {
+	case "":
+		// A reply nobody waited for
+		if msg.status == "ERROR" {
+			log.Error(msg.payload)
+		} else if len(msg.lines) > 0 && msg.lines[0] != "OpenVPN STATISTICS" {
+			status, err := ParseStatus(msg.lines)
+			if err != nil {
+				log.Error("Invalid client list: ", err)
+				return
+			}
+			m.clientList(status)
+		}
+	case "LOG": // -- Log message output as controlled by the "log" command.
+		log.Trace(msg.payload)
+
+		r, ok := parseLogRecord(msg.payload)
+		if !ok {
+			log.Error("Failed to decode log message:", msg.payload)
+			return
+		}
+		m.Conn.logs.addNotification(r)
+
+		fields := strings.SplitN(msg.payload, ",", 3)
+		m.Conn.emit(&LogLine{
+			Since:   r.Time,
+			Flags:   fields[1],
+			Message: r.Message,
+		})
+	case "INFO": // -- Informational messages such as the welcome message.
+		log.Info(msg.payload)
+		m.Conn.emit(&Info{Message: msg.payload})
+	case "FATAL": // -- A fatal error which is output to the log file just prior to OpenVPN exiting.
+		log.Critical(msg.payload)
+		m.Conn.setFatal(msg.payload)
+		m.Conn.emit(&Fatal{Message: msg.payload})
+	case "HOLD": // -- Used to indicate that OpenVPN is in a holding state and will not start until it receives a "hold release" command.
+		log.Info("HOLD active:", msg.payload)
+		m.Conn.emit(&Hold{Message: msg.payload})
+
+		go m.holdRelease()
+	case "STATE": // -- Shows the current OpenVPN state, as controlled by the "state" command.
+		m.state(msg.payload)
+	case "ECHO": // -- Echo messages as controlled by the "echo" command. {TIME},{MESSAGE}
+		fields := strings.SplitN(msg.payload, ",", 2)
+		if len(fields) < 2 {
+			log.Error("Failed to decode echo:", msg.payload)
+			return
+		}
+
+		e := &EchoMessage{
+			Since:   parseUnixTime(fields[0]),
+			Message: fields[1],
+		}
+		m.Conn.emit(e)
+
+		select {
+		case m.Conn.Echo <- e:
+		default:
+			log.Warn("Lost echo: ", e.Message)
+		}
+	case "NEED-OK": // -- OpenVPN needs the end user to do something, such as insert a cryptographic token. Answered with "needok".
+		name, message, ok := parseNeed(msg.payload, "confirmation")
+		if !ok {
+			log.Error("Failed to decode NEED-OK:", msg.payload)
+			return
+		}
+
+		e := &NeedOk{Name: name, Message: message}
+		m.Conn.emit(e)
+		go m.prompt(e)
+	case "NEED-STR": // -- OpenVPN needs information from end, such as a certificate to use. Answered with "needstr".
+		name, message, ok := parseNeed(msg.payload, "input")
+		if !ok {
+			log.Error("Failed to decode NEED-STR:", msg.payload)
+			return
+		}
+
+		e := &NeedStr{Name: name, Message: message}
+		m.Conn.emit(e)
+		go m.prompt(e)
+	case "PASSWORD": // -- Used to tell the management client that OpenVPN needs a password, also to indicate password verification failure.
+		m.password(msg.payload)
+	case "BYTECOUNT": // -- Real-time bandwidth usage notification when OpenVPN is running as a client. {IN},{OUT}
+		fields := strings.Split(msg.payload, ",")
+		if len(fields) != 2 {
+			log.Error("Failed to decode bytecount:", msg.payload)
+			return
+		}
+
+		in, _ := strconv.ParseUint(fields[0], 10, 64)
+		out, _ := strconv.ParseUint(fields[1], 10, 64)
+
+		m.Conn.lock.Lock()
+		m.Conn.traffic.update(in, out, time.Now())
+		traffic := m.Conn.traffic
+		m.Conn.lock.Unlock()
+
+		m.Conn.emit(&ByteCount{
+			BytesIn:  in,
+			BytesOut: out,
+			RateIn:   traffic.RateIn,
+			RateOut:  traffic.RateOut,
+		})
+	case "BYTECOUNT_CLI": // -- Real-time bandwidth usage notification per-client when OpenVPN is running as a server. {CID},{IN},{OUT}
+		fields := strings.Split(msg.payload, ",")
+		if len(fields) != 3 {
+			log.Error("Failed to decode bytecount:", msg.payload)
+			return
+		}
+
+		m.byteCount(fields[0], fields[1], fields[2])
+	case "UPDOWN": // -- >UPDOWN:ENV,{NAME}={VALUE}
+		if strings.HasPrefix(msg.payload, "ENV,") {
+			if i := strings.Index(msg.payload, "="); i > 0 {
+				m.Conn.Env[msg.payload[len("ENV,"):i]] = msg.payload[i+1:]
+			}
+		}
+	case "CLIENT":
+		m.client(msg)
+	default:
+		log.Error(msg.kind, ": ", msg.payload)
+	}
+} // }}}
+
+func (m *Management) state(payload string) { // {{{
+	state := strings.Split(payload, ",")
+	if len(state) < 2 {
+		log.Error("Failed to decode state:", state)
+		return
+	}
+
+	log.Info("STATE:", state[1])
+
+	e := &StateChanged{
+		Since: parseUnixTime(state[0]),
+		State: state[1],
+	}
+	if len(state) > 2 {
+		e.Description = state[2]
+	}
+	if len(state) > 3 {
+		e.LocalIP = state[3]
+	}
+	if len(state) > 4 {
+		e.RemoteIP = state[4]
+	}
+	m.Conn.lock.Lock()
+	m.Conn.state = e.State
+	m.Conn.lock.Unlock()
+
+	m.Conn.emit(e)
+
+	switch state[1] {
+	case "CONNECTING":
+	case "RESOLVE":
+	case "WAIT":
+	case "AUTH":
+	case "GET_CONFIG":
+	case "ASSIGN_IP":
+	case "ADD_ROUTES":
+	case "CONNECTED":
+		m.Conn.Fire("Connected", e.LocalIP)
+	case "RECONNECTING":
+		m.Conn.Fire("Disconnected")
+	case "EXITING":
+		m.Conn.Fire("Disconnected")
+		m.Conn.setExiting()
+	default:
+		log.Error("Recived unkown state:", state[1])
+	}
+} // }}}
+
+// password handles >PASSWORD:Need '{REALM}' ... and >PASSWORD:Verification Failed: '{REALM}' ...
+func (m *Management) password(payload string) { // {{{
+	switch {
+	case strings.HasPrefix(payload, "Need '"):
+		realm, what, ok := splitQuoted(payload[len("Need "):])
+		if !ok {
+			log.Error("Failed to decode password request:", payload)
+			return
+		}
+
+		go m.credentials(parseCredentialRequest(realm, strings.TrimSpace(what)))
+	case strings.HasPrefix(payload, "Verification Failed: '"):
+		realm, rest, ok := splitQuoted(payload[len("Verification Failed: "):])
+		if !ok {
+			log.Error("Failed to decode password failure:", payload)
+			return
+		}
+
+		e := &AuthFailed{
+			Realm:     realm,
+			Message:   strings.TrimSpace(rest),
+			Challenge: parseDynamicChallenge(rest),
+		}
+
+		if e.Challenge != nil {
+			log.Info("Management: '", realm, "' challenge received: ", e.Challenge.Text)
+			m.setChallenge(e.Challenge)
+		} else {
+			log.Warn("Management: '", realm, "' verification failed")
+		}
+		m.Conn.emit(e)
+	default:
+		log.Trace("PASSWORD:", payload)
+	}
+} // }}}
+
+func (m *Management) byteCount(cid, bytesIn, bytesOut string) { // {{{
+	in, _ := strconv.ParseUint(bytesIn, 10, 64)
+	out, _ := strconv.ParseUint(bytesOut, 10, 64)
+
+	e := &ByteCount{
+		ClientID: cid,
+		BytesIn:  in,
+		BytesOut: out,
+	}
+
+	m.Conn.clientLock.Lock()
+	if client, ok := m.Conn.Clients[cid]; ok {
+		client.Traffic.update(in, out, time.Now())
+		client.BytesRecived = bytesIn
+		client.BytesSent = bytesOut
+
+		e.RateIn = client.Traffic.RateIn
+		e.RateOut = client.Traffic.RateOut
+	}
+	m.Conn.clientLock.Unlock()
+
+	m.Conn.emit(e)
+} // }}}
 
-		clientEnv: make(map[string]string, 0),
-		buffer:    make([]byte, 0),
-		shutdown:  make(chan bool),
+// client handles the >CLIENT: notifications, sent when running as a server
+// with management-client-auth.
+//
+//	CID  -- Client ID, numerical ID for each connecting client, sequence = 0,1,2,...
+//	KID  -- Key ID, numerical ID for the key associated with a given client TLS session, sequence = 0,1,2,...
+//	PRI  -- Primary (1) or Secondary (0) VPN address/subnet. All clients have at least one primary IP address.
+//	        Secondary address/subnets are associated with client-specific "iroute" directives.
+//	ADDR -- IPv4 address/subnet in the form 1.2.3.4 or 1.2.3.0/255.255.255.0
+func (m *Management) client(msg *message) { // {{{
+	fields := strings.Split(msg.payload, ",")
+
+	switch fields[0] {
+	case "CONNECT", "REAUTH": // Notify new client connection or existing client TLS session renegotiation {CID},{KID}
+		if len(fields) < 3 {
+			log.Error("Failed to decode client notification:", msg.payload)
+			return
+		}
+
+		// Let the authorizer decide if the client is allowed in
+		if m.Conn.Authorizer != nil {
+			req := &AuthRequest{
+				ClientID: fields[1],
+				KeyID:    fields[2],
+				Reauth:   fields[0] == "REAUTH",
+				Env:      make(map[string]string, len(msg.env)),
+			}
+			for key, val := range msg.env {
+				req.Env[key] = val
+			}
+
+			m.authorize(req)
+		}
+
+		m.clientEnv(fields[1], msg.env, false)
+	case "ESTABLISHED": // Notify successful client authentication and session initiation {CID}
+		if len(fields) < 2 {
+			log.Error("Failed to decode client notification:", msg.payload)
+			return
+		}
+
+		m.clientEnv(fields[1], msg.env, true)
+	case "DISCONNECT": // Notify existing client disconnection {CID}
+		if len(fields) < 2 {
+			log.Error("Failed to decode client notification:", msg.payload)
+			return
+		}
+
+		m.dropAuths(fields[1])
+		m.clientDisconnect(fields[1])
+	case "ADDRESS": // Notify that a particular virtual address or subnet is now associated with a specific client {CID},{ADDR},{PRI}
+		if len(fields) < 4 {
+			log.Error("Failed to decode client address:", msg.payload)
+			return
+		}
+
+		m.clientAddress(fields[1], fields[2], fields[3] == "1")
+		m.Conn.emit(&ClientAddressLearned{
+			ClientID: fields[1],
+			Address:  fields[2],
+			Primary:  fields[3] == "1",
+		})
+	default:
+		log.Trace("CLIENT:", msg.payload)
+	}
+} // }}}
+
+// clientEnv adds or updates the session with the environment sent by openvpn
+func (m *Management) clientEnv(cid string, env map[string]string, established bool) { // {{{
+	// Never keep the password around
+	delete(env, "password")
+
+	m.Conn.clientLock.Lock()
+	defer m.Conn.clientLock.Unlock()
+
+	client, ok := m.Conn.Clients[cid]
+	if !ok {
+		client = m.Conn.authenticating[cid]
+	}
+	if client == nil {
+		client = &Client{
+			ID:           cid,
+			BytesRecived: "0",
+			BytesSent:    "0",
+			LastRef:      "0",
+			Env:          make(map[string]string, 0),
+		}
 	}
+
+	update := func(c *Client) {
+		for key, val := range env {
+			c.Env[key] = val
+		}
+
+		// common_name is the username with username-as-common-name
+		if cn := c.Env["common_name"]; cn != "" {
+			c.CommonName = cn
+		} else if cn := c.Env["X509_0_CN"]; cn != "" {
+			c.CommonName = cn
+		}
+		c.Username = c.Env["username"]
+
+		if ip := c.Env["untrusted_ip"]; ip != "" {
+			c.PublicIP = net.JoinHostPort(ip, c.Env["untrusted_port"])
+		}
+		if ip := c.Env["ifconfig_pool_remote_ip"]; ip != "" {
+			c.PrivateIP = ip
+		}
+		if ip := c.Env["ifconfig_pool_remote_ip6"]; ip != "" {
+			c.PrivateIPv6 = ip
+		}
+		if since := c.Env["time_unix"]; since != "" {
+			c.ConnectedSince = parseUnixTime(since)
+		}
+		if established {
+			c.Established = true
+		}
+	}
+
+	if ok {
+		m.Conn.updateClient(client, update)
+		m.Conn.Fire("client updated", client.CommonName, cid)
+		return
+	}
+
+	update(client)
+
+	// Keep the session out of the client list until openvpn has accepted it
+	if !established {
+		m.Conn.authenticating[cid] = client
+		return
+	}
+	delete(m.Conn.authenticating, cid)
+	m.Conn.addClient(client)
+
+	m.Conn.Fire("client connected", client.CommonName, cid)
+	m.Conn.emit(&ClientConnected{
+		ClientID:   cid,
+		CommonName: client.CommonName,
+	})
+} // }}}
+
+func (m *Management) clientAddress(cid, addr string, primary bool) { // {{{
+	m.Conn.clientLock.Lock()
+	defer m.Conn.clientLock.Unlock()
+
+	client, ok := m.Conn.Clients[cid]
+	if !ok || !primary {
+		return
+	}
+
+	m.Conn.updateClient(client, func(c *Client) {
+		if strings.Contains(addr, ":") {
+			c.PrivateIPv6 = addr
+		} else {
+			c.PrivateIP = addr
+		}
+	})
+
+	if client.waitForPrivateIP != nil {
+		close(client.waitForPrivateIP)
+		client.waitForPrivateIP = nil
+	}
+} // }}}
+
+func (m *Management) clientDisconnect(cid string) { // {{{
+	m.Conn.clientLock.Lock()
+	defer m.Conn.clientLock.Unlock()
+
+	// A client that was denied never connected
+	delete(m.Conn.authenticating, cid)
+
+	client, ok := m.Conn.Clients[cid]
+	if !ok {
+		return
+	}
+	m.Conn.removeClient(client)
+	m.Conn.clientRemoved(client)
+} // }}}
+
+// clientList updates the client list from a status reply. The status is the
+// only source of clients when openvpn runs without management-client-auth.
+// Sessions are matched by client ID, or by common name and real address for
+// old versions of openvpn that doesnt list it.
+func (m *Management) clientList(status *Status) { // {{{
+	m.Conn.clientLock.Lock()
+	defer m.Conn.clientLock.Unlock()
+
+	seen := make(map[string]bool, len(status.Clients))
+
+	for _, c := range status.Clients {
+		cid := c.ClientID
+		if cid == "" {
+			cid = c.RealAddress
+			for _, client := range m.Conn.clientIndex.commonName[c.CommonName] {
+				if client.PublicIP == c.RealAddress {
+					cid = client.ID
+				}
+			}
+		}
+		seen[cid] = true
+
+		update := func(client *Client) {
+			client.missing = 0
+			client.CommonName = c.CommonName
+			client.PublicIP = c.RealAddress
+			client.BytesRecived = strconv.FormatUint(c.BytesReceived, 10)
+			client.BytesSent = strconv.FormatUint(c.BytesSent, 10)
+			client.ConnectedSince = c.ConnectedSince
+			client.PeerID = c.PeerID
+			client.Cipher = c.DataChannelCipher
+			client.Established = true
+
+			if c.Username != "" && c.Username != "UNDEF" {
+				client.Username = c.Username
+			}
+			if c.VirtualAddress != "" {
+				client.PrivateIP = c.VirtualAddress
+			}
+			if c.VirtualIPv6Address != "" {
+				client.PrivateIPv6 = c.VirtualIPv6Address
+			}
+		}
+
+		if client, ok := m.Conn.Clients[cid]; ok {
+			m.Conn.updateClient(client, update)
+			continue
+		}
+
+		client := &Client{ID: cid}
+		update(client)
+		delete(m.Conn.authenticating, cid)
+		m.Conn.addClient(client)
+
+		m.Conn.Fire("client connected", c.CommonName, cid)
+		m.Conn.emit(&ClientConnected{
+			ClientID:   cid,
+			CommonName: c.CommonName,
+		})
+	}
+
+	for _, r := range status.Routes {
+		if client, ok := m.Conn.clientIndex.address[r.VirtualAddress]; ok {
+			client.LastRef = r.LastRef.Format(statusTimeLayout)
+
+			if client.waitForPrivateIP != nil {
+				close(client.waitForPrivateIP)
+				client.waitForPrivateIP = nil
+			}
+		}
+	}
+
+	// Remove all clients that isnt connected
+	for cid, client := range m.Conn.Clients {
+		if seen[cid] {
+			continue
+		}
+
+		client.missing++
+		if client.missing > 5 {
+			m.Conn.removeClient(client)
+			m.Conn.clientRemoved(client)
+		}
+	}
+} // }}}
+
+// splitQuoted splits "'name' rest" into name and rest
+func splitQuoted(s string) (name, rest string, ok bool) {
+	if !strings.HasPrefix(s, "'") {
+		return "", "", false
+	}
+
+	end := strings.Index(s[1:], "'")
+	if end < 0 {
+		return "", "", false
+	}
+	return s[1 : end+1], s[end+2:], true
 }
+
+// parseNeed decodes "Need '{NAME}' {what} MSG:{MESSAGE}" sent with >NEED-OK and >NEED-STR
+func parseNeed(payload, what string) (name, message string, ok bool) {
+	if !strings.HasPrefix(payload, "Need ") {
+		return "", "", false
+	}
+
+	name, rest, ok := splitQuoted(payload[len("Need "):])
+	if !ok {
+		return "", "", false
+	}
+
+	rest = strings.TrimPrefix(strings.TrimSpace(rest), what)
+	return name, strings.TrimPrefix(strings.TrimSpace(rest), "MSG:"), true
+}
+
+func Clone(a, b interface{}) { // {{{
+
+	buff := new(bytes.Buffer)
+	enc := gob.NewEncoder(buff)
+	dec := gob.NewDecoder(buff)
+	enc.Encode(a)
+	dec.Decode(b)
+} // }}}
@@ -1,13 +1,20 @@
 package openvpn
 
 import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
-	"sync"
+	"strings"
 	"testing"
+	"time"
 )
 
-var waitGroup sync.WaitGroup
-
 func init() {
 	//logger, err := log.LoggerFromConfigAsFile("logconfig.xml")
 	//if err != nil {
@@ -58,78 +65,1402 @@ func TestNewManagement(t *testing.T) {
 }
 
 func TestParse(t *testing.T) {
-	m := &Management{
-		events: make(chan []string),
-		buffer: make([]byte, 0),
+	p := newParser()
+
+	lines := []string{
+		"OpenVPN CLIENT LIST",
+		"Updated, Thu Feb 13 23:39:20 2014",
+		"Common Name,Real Address,Bytes Received,Bytes Sent,Connected Since",
+		"VPN_client,10.13.156.4:1194,12563,14885,Thu Feb 13 23:39:20 2014",
+		">BYTECOUNT_CLI:0,12563,14885", // Notifications may be interleaved with replies
+		"",
+		"ROUTING TABLE",
+		"Virtual Address,Common Name,Real Address,Last Ref",
+		"192.168.11.4,VPN_client,10.13.156.4:1194,Thu Feb 13 23:39:20 2014",
+		"",
+		"GLOBAL STATS",
+		"Max bcast/mcast queue length,0",
+	}
+
+	for _, line := range lines {
+		msg := p.feed(line)
+		if msg == nil {
+			continue
+		}
+
+		if msg.kind != "BYTECOUNT_CLI" || msg.payload != "0,12563,14885" {
+			t.Error("Invalid notification: ", msg)
+		}
+	}
+
+	result := p.feed("END")
+	if result == nil {
+		t.Fatal("Parse done without result")
+	}
+	for index := range result.lines {
+		t.Log("Result[", index, "]: \n", strconv.Quote(result.lines[index]))
+	}
+
+	if result.kind != "" || len(result.lines) != 11 {
+		t.Error("Wrong length on answer, should be 11, is ", len(result.lines))
+	}
+
+	clients, routes, ok := parseStatusV1(result.lines)
+	if !ok {
+		t.Fatal("Failed to decode the client list")
+	}
+	if len(clients) != 1 || clients[0]["Common Name"] != "VPN_client" || clients[0]["Bytes Received"] != "12563" {
+		t.Error("clients is invalid: ", clients)
+	}
+	if len(routes) != 1 || routes[0]["Virtual Address"] != "192.168.11.4" || routes[0]["Common Name"] != "VPN_client" {
+		t.Error("routes is invalid: ", routes)
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	v3 := []string{
+		"TITLE\tOpenVPN 2.4.4 x86_64-pc-linux-gnu",
+		"TIME\tThu Feb 13 23:39:20 2014\t1392331160",
+		"HEADER\tCLIENT_LIST\tCommon Name\tReal Address\tVirtual Address\tVirtual IPv6 Address\tBytes Received\tBytes Sent\tConnected Since\tConnected Since (time_t)\tUsername\tClient ID\tPeer ID\tData Channel Cipher",
+		"CLIENT_LIST\tVPN_client\t10.13.156.4:1194\t10.8.0.6\tfd00::1000\t12563\t14885\tThu Feb 13 23:39:20 2014\t1392331160\tdoe, john\t7\t0\tAES-256-GCM",
+		"HEADER\tROUTING_TABLE\tVirtual Address\tCommon Name\tReal Address\tLast Ref\tLast Ref (time_t)",
+		"ROUTING_TABLE\t10.8.0.6\tVPN_client\t10.13.156.4:1194\tThu Feb 13 23:39:20 2014\t1392331160",
+		"GLOBAL_STATS\tMax bcast/mcast queue length\t0",
+	}
+
+	status, err := ParseStatus(v3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Version != 3 || status.Title != "OpenVPN 2.4.4 x86_64-pc-linux-gnu" || status.Updated.Unix() != 1392331160 {
+		t.Error("Invalid header: ", status)
+	}
+	if len(status.Clients) != 1 {
+		t.Fatal("Wrong number of clients: ", status.Clients)
+	}
+
+	c := status.Clients[0]
+	if c.CommonName != "VPN_client" || c.VirtualAddress != "10.8.0.6" || c.VirtualIPv6Address != "fd00::1000" ||
+		c.BytesReceived != 12563 || c.BytesSent != 14885 || c.ConnectedSince.Unix() != 1392331160 ||
+		c.Username != "doe, john" || c.ClientID != "7" || c.PeerID != "0" || c.DataChannelCipher != "AES-256-GCM" {
+		t.Errorf("Invalid client: %+v", c)
+	}
+	if len(status.Routes) != 1 || status.Routes[0].CommonName != "VPN_client" || status.Routes[0].LastRef.Unix() != 1392331160 {
+		t.Error("Invalid routes: ", status.Routes)
+	}
+	if status.GlobalStats["Max bcast/mcast queue length"] != "0" {
+		t.Error("Invalid global stats: ", status.GlobalStats)
+	}
+
+	// Version 2 is the same, but comma delimited
+	v2 := make([]string, len(v3))
+	for i, line := range v3 {
+		v2[i] = strings.Replace(strings.Replace(line, "doe, john", "john", 1), "\t", ",", -1)
 	}
+	if status, err = ParseStatus(v2); err != nil || status.Version != 2 || len(status.Clients) != 1 || status.Clients[0].Username != "john" {
+		t.Error("Failed to parse version 2: ", status, err)
+	}
+
+	// Version 1 only has the virtual address in the routing table
+	if status, err = ParseStatus(statusLines(2)); err != nil || status.Version != 1 || len(status.Clients) != 2 || status.Clients[1].VirtualAddress == "" {
+		t.Error("Failed to parse version 1: ", status, err)
+	}
+
+	if _, err = ParseStatus([]string{"OpenVPN STATISTICS"}); err == nil {
+		t.Error("Client statistics should not parse as a status")
+	}
+}
 
-	done := make(chan bool)
+func TestParseReplies(t *testing.T) {
+	p := newParser()
+
+	if msg := p.feed("SUCCESS: pid=4711"); msg == nil || msg.status != "SUCCESS" || msg.payload != "pid=4711" {
+		t.Error("Invalid success: ", msg)
+	}
+	if msg := p.feed("ERROR: unknown command"); msg == nil || msg.status != "ERROR" || msg.payload != "unknown command" {
+		t.Error("Invalid error: ", msg)
+	}
+
+	// Client notifications are delivered once the ENV block is complete
+	for _, line := range []string{">CLIENT:CONNECT,4,1", ">CLIENT:ENV,username=alice", ">CLIENT:ENV,empty="} {
+		if msg := p.feed(line); msg != nil {
+			t.Error("Client notification delivered too early: ", msg)
+		}
+	}
+	msg := p.feed(">CLIENT:ENV,END")
+	if msg == nil || msg.kind != "CLIENT" || msg.payload != "CONNECT,4,1" || msg.env["username"] != "alice" || len(msg.env) != 2 {
+		t.Error("Invalid client notification: ", msg)
+	}
+	if msg := p.feed(">CLIENT:ADDRESS,4,10.8.0.6,1"); msg == nil || msg.payload != "ADDRESS,4,10.8.0.6,1" {
+		t.Error("Invalid client address: ", msg)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	p, client := pipeManagement(t)
+	m := p.management
+
+	// A fake openvpn answering the commands
 	go func() {
-		waitGroup.Add(1)
-		defer waitGroup.Done()
+		for {
+			line, err := client.ReadLine()
+			if err != nil {
+				return
+			}
+			switch line {
+			case "pid":
+				client.Write([]byte(">INFO:Interleaved notification\r\nSUCCESS: pid=42\r\n"))
+			case "version":
+				client.Write([]byte("OpenVPN Version: OpenVPN 2.4.0\r\nManagement Version: 1\r\nEND\r\n"))
+			default:
+				client.Write([]byte("ERROR: unknown command, enter 'help' for more options\r\n"))
+			}
+		}
+	}()
 
-		select {
-		case result := <-m.events:
-			for index := range result {
-				t.Log("Result[", index, "]: \n", strconv.Quote(result[index]))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	resp, err := m.Command(ctx, "pid")
+	if err != nil || !resp.Success || resp.Message != "pid=42" {
+		t.Error("Invalid pid response: ", resp, err)
+	}
+
+	resp, err = m.Command(ctx, "version")
+	if err != nil || len(resp.Lines) != 2 || resp.Lines[1] != "Management Version: 1" {
+		t.Error("Invalid version response: ", resp, err)
+	}
+
+	resp, err = m.Command(ctx, "foo")
+	if _, ok := err.(*CommandError); !ok || resp.Success {
+		t.Error("Expected a CommandError, got: ", resp, err)
+	}
+
+	if _, err = m.Command(ctx, "pid\nhold release"); err == nil {
+		t.Error("Commands with line breaks should be rejected")
+	}
+}
+
+func TestLongLine(t *testing.T) {
+	p, client := pipeManagement(t)
+
+	go func() {
+		if _, err := client.ReadLine(); err != nil {
+			return
+		}
+		client.Write([]byte(">CLIENT:ENV,X509_0_CN=" + strings.Repeat("x", 70*1024) + "\r\nSUCCESS: pid=42\r\n"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if resp, err := p.Command(ctx, "pid"); err != nil || resp.Message != "pid=42" {
+		t.Error("The connection did not survive a long line: ", resp, err)
+	}
+}
+
+func TestAbandonedCommand(t *testing.T) {
+	defer func(timeout time.Duration) { abandonedReplyTimeout = timeout }(abandonedReplyTimeout)
+	abandonedReplyTimeout = time.Millisecond * 100
+
+	p, client := pipeManagement(t)
+
+	// A hung openvpn reading commands but never answering
+	go func() {
+		for {
+			if _, err := client.ReadLine(); err != nil {
+				return
 			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := p.Command(ctx, "pid"); err != context.DeadlineExceeded {
+		t.Fatal("Expected a timeout, got: ", err)
+	}
+
+	// The connection is closed instead of blocking the next command forever
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := p.Command(ctx, "pid"); err != ErrNotConnected {
+		t.Error("Expected ErrNotConnected, got: ", err)
+	}
+}
 
-			if len(result) != 6 {
-				t.Error("Wrong length on answer, should be 5, is ", len(result))
+func TestKillClient(t *testing.T) {
+	p, client := pipeManagement(t)
+	m := p.management
+	m.route(&message{kind: "CLIENT", payload: "CONNECT,5,0", env: map[string]string{"common_name": "alice"}})
+	m.route(&message{kind: "CLIENT", payload: "ESTABLISHED,5", env: map[string]string{}})
+	<-p.TypedEvents // ClientConnected
+
+	commands := make(chan string, 10)
+	go func() {
+		for {
+			line, err := client.ReadLine()
+			if err != nil {
+				return
+			}
+			commands <- line
+
+			switch line {
+			case "client-kill 5 HALT":
+				client.Write([]byte("SUCCESS: client-kill command succeeded\r\n>CLIENT:DISCONNECT,5\r\n>CLIENT:ENV,END\r\n"))
+			default:
+				client.Write([]byte("ERROR: common name 'bob' not found\r\n"))
 			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
 
-			if result[0] != "client-list" {
-				t.Error("result[0] is invalid")
+	if _, err := p.KillCommonName(ctx, "bob"); err == nil {
+		t.Error("Killing an unknown common name should fail")
+	}
+	if cmd := <-commands; cmd != `kill "bob"` {
+		t.Error("Invalid command: ", cmd)
+	}
+
+	// Common names with spaces are sent as one argument
+	p.KillCommonName(ctx, `John "JD" Doe`)
+	if cmd := <-commands; cmd != `kill "John \"JD\" Doe"` {
+		t.Error("Invalid command: ", cmd)
+	}
+
+	resp, err := p.KillClient(ctx, "5", KillHalt)
+	if err != nil || !resp.Success {
+		t.Error("Invalid client-kill response: ", resp, err)
+	}
+	if cmd := <-commands; cmd != "client-kill 5 HALT" {
+		t.Error("Invalid command: ", cmd)
+	}
+
+	for {
+		select {
+		case event := <-p.TypedEvents:
+			e, ok := event.(*ClientKilled)
+			if !ok {
+				continue
 			}
-			if result[1] != "OpenVPN CLIENT LIST\n"+
-				"Updated, Thu Feb 13 23:39:20 2014\n"+
-				"Common Name,Real Address,Bytes Received,Bytes Sent,Connected Since\n"+
-				"VPN_client,10.13.156.4:1194,12563,14885,Thu Feb 13 23:39:20 2014\n"+
-				"ROUTING TABLE\n"+
-				"Virtual Address,Common Name,Real Address,Last Ref\n"+
-				"192.168.11.4,VPN_client,10.13.156.4:1194,Thu Feb 13 23:39:20 2014\n"+
-				"GLOBAL STATS\n"+
-				"Max bcast/mcast queue length,0\n"+
-				"END\n" {
-				t.Error("result[1] is invalid")
+			if e.ClientID != "5" || e.CommonName != "alice" || e.Mode != KillHalt {
+				t.Error("Invalid kill event: ", e)
 			}
-			if result[2] != " Thu Feb 13 23:39:20 2014" {
-				t.Error("result[2] is invalid")
+			if _, ok := p.Client("5"); ok {
+				t.Error("Client 5 is still connected")
 			}
-			if result[3] !=
-				"Common Name,Real Address,Bytes Received,Bytes Sent,Connected Since\n"+
-					"VPN_client,10.13.156.4:1194,12563,14885,Thu Feb 13 23:39:20 2014" {
-				t.Error("result[3] is invalid")
+			return
+		case <-ctx.Done():
+			t.Fatal("Timeout waiting for the kill event")
+		}
+	}
+}
+
+func TestTypedEvents(t *testing.T) {
+	p := NewProcess()
+	m := p.management
+
+	m.route(&message{kind: "STATE", payload: "1392331160,CONNECTED,SUCCESS,10.8.0.6,1.2.3.4"})
+	m.route(&message{kind: "LOG", payload: "1392331161,W,Something happened, again"})
+
+	e := (<-p.TypedEvents).(*StateChanged)
+	if e.State != "CONNECTED" || e.LocalIP != "10.8.0.6" || e.RemoteIP != "1.2.3.4" || e.Since.Unix() != 1392331160 {
+		t.Error("Invalid state event: ", e)
+	}
+
+	l := (<-p.TypedEvents).(*LogLine)
+	if l.Flags != "W" || l.Message != "Something happened, again" {
+		t.Error("Invalid log event: ", l)
+	}
+
+	if l.Seq != e.Seq+1 || l.Time.Before(e.Time) {
+		t.Error("Events are not sequenced: ", e.Header(), l.Header())
+	}
+}
+
+func TestByteCount(t *testing.T) {
+	p := NewProcess()
+	m := p.management
+	p.Clients["3"] = &Client{ID: "3", CommonName: "VPN_client"}
+
+	now := time.Now()
+	p.Clients["3"].Traffic.update(1000, 500, now.Add(-time.Second*2))
+
+	m.route(&message{kind: "BYTECOUNT_CLI", payload: "3,5000,2500"})
+
+	e := (<-p.TypedEvents).(*ByteCount)
+	if e.ClientID != "3" || e.BytesIn != 5000 || e.BytesOut != 2500 {
+		t.Error("Invalid bytecount event: ", e)
+	}
+	if e.RateIn < 1900 || e.RateIn > 2000 || e.RateOut < 950 || e.RateOut > 1000 {
+		t.Error("Invalid rates: ", e.RateIn, e.RateOut)
+	}
+	if p.Clients["3"].Traffic.BytesIn != 5000 || p.Clients["3"].BytesSent != "2500" {
+		t.Error("Client counters not updated: ", p.Clients["3"])
+	}
+
+	// Client mode
+	m.route(&message{kind: "BYTECOUNT", payload: "100,200"})
+	<-p.TypedEvents
+	if traffic := p.Traffic(); traffic.BytesIn != 100 || traffic.BytesOut != 200 {
+		t.Error("Traffic not updated: ", traffic)
+	}
+}
+
+func TestClientLifecycle(t *testing.T) {
+	p := NewProcess()
+	m := p.management
+
+	// Two sessions sharing a common name, as with duplicate-cn
+	for _, cid := range []string{"1", "2"} {
+		m.route(&message{kind: "CLIENT", payload: "CONNECT," + cid + ",0", env: map[string]string{
+			"common_name":    "shared",
+			"username":       "user" + cid,
+			"password":       "secret",
+			"untrusted_ip":   "10.13.156.4",
+			"untrusted_port": "100" + cid,
+		}})
+		if _, ok := p.Client(cid); ok {
+			t.Error("Client listed before it is authenticated: ", cid)
+		}
+		m.route(&message{kind: "CLIENT", payload: "ESTABLISHED," + cid, env: map[string]string{
+			"ifconfig_pool_remote_ip": "10.8.0." + cid,
+			"time_unix":               "1392331160",
+		}})
+	}
+
+	// A client that is denied is never listed
+	m.route(&message{kind: "CLIENT", payload: "CONNECT,3,0", env: map[string]string{"common_name": "denied"}})
+	if _, ok := p.Client("3"); ok {
+		t.Error("Client 3 listed before it is authenticated")
+	}
+	m.route(&message{kind: "CLIENT", payload: "DISCONNECT,3", env: map[string]string{}})
+
+	if list := p.ClientList(); len(list) != 2 || list[0].ID != "1" || list[1].ID != "2" {
+		t.Fatal("Invalid client list: ", list)
+	}
+	if list := p.ClientsByCommonName("shared"); len(list) != 2 {
+		t.Error("Wrong number of clients by common name: ", list)
+	}
+	if list := p.ClientsByUsername("user2"); len(list) != 1 || list[0].ID != "2" {
+		t.Error("Invalid clients by username: ", list)
+	}
+
+	c, ok := p.ClientByAddress("10.8.0.1")
+	if !ok || c.ID != "1" || c.PublicIP != "10.13.156.4:1001" || !c.Established || c.ConnectedSince.Unix() != 1392331160 {
+		t.Errorf("Invalid client by address: %+v", c)
+	}
+	if _, ok := c.Env["password"]; ok {
+		t.Error("The password was kept")
+	}
+
+	// The address learned by openvpn replaces the one from the pool
+	m.route(&message{kind: "CLIENT", payload: "ADDRESS,1,10.8.0.100,1"})
+	if _, ok := p.ClientByAddress("10.8.0.1"); ok {
+		t.Error("The old address is still indexed")
+	}
+	if c, ok := p.ClientByAddress("10.8.0.100"); !ok || c.ID != "1" {
+		t.Error("The learned address is not indexed: ", c)
+	}
+
+	m.route(&message{kind: "CLIENT", payload: "DISCONNECT,1", env: map[string]string{}})
+	if _, ok := p.Client("1"); ok {
+		t.Error("Client 1 is still connected")
+	}
+	if list := p.ClientsByCommonName("shared"); len(list) != 1 || list[0].ID != "2" {
+		t.Error("Invalid clients after disconnect: ", list)
+	}
+
+	var connected, disconnected int
+	for len(p.TypedEvents) > 0 {
+		switch e := (<-p.TypedEvents).(type) {
+		case *ClientConnected:
+			connected++
+		case *ClientDisconnected:
+			disconnected++
+			if e.ClientID != "1" || e.CommonName != "shared" {
+				t.Error("Invalid disconnect event: ", e)
 			}
-			if result[4] !=
-				"Virtual Address,Common Name,Real Address,Last Ref\n"+
-					"192.168.11.4,VPN_client,10.13.156.4:1194,Thu Feb 13 23:39:20 2014" {
-				t.Error("result[4] is invalid")
+		}
+	}
+	if connected != 2 || disconnected != 1 {
+		t.Error("Wrong number of events: ", connected, disconnected)
+	}
+}
+
+func TestClientListStatus(t *testing.T) {
+	p := NewProcess()
+	m := p.management
+
+	status, err := ParseStatus(statusLines(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.clientList(status)
+	if list := p.ClientList(); len(list) != 3 {
+		t.Fatal("Wrong number of clients: ", list)
+	}
+	if c, ok := p.ClientByAddress("10.8.0.3"); !ok || c.CommonName != "client1" || c.BytesSent != "14885" {
+		t.Error("Invalid client: ", c)
+	}
+
+	// Clients missing from the status are removed after a few polls
+	status.Clients = status.Clients[1:]
+	for i := 0; i < 6; i++ {
+		m.clientList(status)
+	}
+	if list := p.ClientsByCommonName("client0"); len(list) != 0 {
+		t.Error("client0 was not removed: ", list)
+	}
+	if list := p.ClientList(); len(list) != 2 {
+		t.Error("Wrong number of clients: ", list)
+	}
+}
+
+func TestLogBuffer(t *testing.T) {
+	p := NewProcess()
+	p.logs = NewLogBuffer(3)
+
+	sub := p.Logs().Subscribe(1)
+	defer sub.Close()
+
+	p.logs.add(parseOutputLine("2026-10-18 12:00:00 OpenVPN 2.5.1 x86_64-pc-linux-gnu", "stdout"))
+	p.logs.add(parseOutputLine("Tue Oct 18 12:00:01 2016 WARNING: file 'ta.key' is group or others accessible", "stdout"))
+
+	// The history from "log all" overlaps with what was read from stdout
+	first := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local).Unix()
+	history := make([]LogRecord, 0)
+	for _, line := range []string{
+		strconv.FormatInt(first, 10) + ",I,OpenVPN 2.5.1 x86_64-pc-linux-gnu",
+		strconv.FormatInt(first+1, 10) + ",I,library versions: OpenSSL 1.1.1",
+	} {
+		r, ok := parseLogRecord(line)
+		if !ok {
+			t.Fatal("Failed to parse ", line)
+		}
+		history = append(history, r)
+	}
+	p.logs.addHistory(history)
+
+	p.management.route(&message{kind: "LOG", payload: strconv.FormatInt(first+2, 10) + ",W,Could not determine IPv4/IPv6 protocol"})
+
+	records := p.Logs().Records()
+	if len(records) != 3 {
+		t.Fatal("Wrong number of records: ", records)
+	}
+	if records[0].Level != LogWarning || records[0].Source != "stdout" || records[0].Time.Year() != 2016 {
+		t.Errorf("Invalid stdout record: %+v", records[0])
+	}
+	if records[1].Message != "library versions: OpenSSL 1.1.1" || records[2].Level != LogWarning || records[2].Source != "management" {
+		t.Error("Invalid records: ", records)
+	}
+
+	// The subscriber only had room for the first record
+	if r := <-sub.C; r.Message != "OpenVPN 2.5.1 x86_64-pc-linux-gnu" {
+		t.Error("Invalid first record: ", r)
+	}
+	if sub.Dropped() != 3 {
+		t.Error("Expected 3 dropped records, got ", sub.Dropped())
+	}
+
+	sub.Close()
+	if _, ok := <-sub.C; ok {
+		t.Error("C was not closed")
+	}
+}
+
+func TestLogSwitch(t *testing.T) {
+	p := NewProcess()
+
+	// Read from stdout before "log on" was answered, and then notified again
+	first := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local).Unix()
+	p.logs.add(parseOutputLine("2026-10-18 12:00:00 Initialization Sequence Completed", "stdout"))
+	p.management.route(&message{kind: "LOG", payload: strconv.FormatInt(first, 10) + ",I,Initialization Sequence Completed"})
+	p.management.route(&message{kind: "LOG", payload: strconv.FormatInt(first+1, 10) + ",I,Initialization Sequence Completed"})
+	p.management.route(&message{kind: "LOG", payload: strconv.FormatInt(first+1, 10) + ",I,Initialization Sequence Completed"})
+
+	records := p.Logs().Records()
+	if len(records) != 3 {
+		t.Fatal("Wrong number of records: ", records)
+	}
+	if records[0].Source != "stdout" || records[1].Source != "management" || records[2].Source != "management" {
+		t.Error("Invalid records: ", records)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	p, client := pipeManagement(t)
+	p.BytecountInterval = time.Second * 5
+	m := p.management
+
+	history := strconv.FormatInt(time.Now().Unix(), 10) + ",I,Initialization Sequence Completed"
+	commands := make(chan string, 10)
+	go func() {
+		for {
+			line, err := client.ReadLine()
+			if err != nil {
+				return
 			}
-			if result[5] != "Max bcast/mcast queue length,0" {
-				t.Error("result[5] is invalid")
+			commands <- line
+
+			switch line {
+			case "log all":
+				client.Write([]byte(history + "\r\nEND\r\n"))
+			case "log on":
+				client.Write([]byte("SUCCESS: real-time log notification set to ON\r\n"))
+			case "pid":
+				client.Write([]byte("SUCCESS: pid=42\r\n"))
+			default:
+				client.Write([]byte("SUCCESS: ok\r\n"))
 			}
+		}
+	}()
+
+	m.notifications()
+
+	for _, expected := range []string{"echo on", "state on", "bytecount 5", "log all", "log on"} {
+		if cmd := <-commands; cmd != expected {
+			t.Errorf("Invalid command %q, expected %q", cmd, expected)
+		}
+	}
+	if !m.isLogging() {
+		t.Error("Real-time logging not enabled")
+	}
+	if records := p.Logs().Records(); len(records) != 1 || records[0].Message != "Initialization Sequence Completed" {
+		t.Error("Invalid log history: ", records)
+	}
+
+	// Every reply was taken by its command
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if resp, err := m.Command(ctx, "pid"); err != nil || resp.Message != "pid=42" {
+		t.Error("Invalid pid response: ", resp, err)
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	p, client := pipeManagement(t)
+	p.Authorizer = AuthorizerFunc(func(req *AuthRequest) AuthResult {
+		if req.Username() == "alice" && req.Password() == "secret" {
+			return Allow("ifconfig-push 10.8.0.10 255.255.255.0")
+		}
+		return AuthResult{Reason: "bad password", ClientReason: "Wrong \"password\""}
+	})
+
+	go client.Write([]byte(">CLIENT:CONNECT,4,1\r\n" +
+		">CLIENT:ENV,username=alice\r\n" +
+		">CLIENT:ENV,password=secret\r\n" +
+		">CLIENT:ENV,END\r\n"))
+
+	lines := make([]string, 0)
+	for len(lines) < 3 {
+		lines = append(lines, client.readLine())
+	}
+	client.Write([]byte("SUCCESS: client-auth command succeeded\r\n"))
+
+	if lines[0] != "client-auth 4 1" || lines[1] != "ifconfig-push 10.8.0.10 255.255.255.0" || lines[2] != "END" {
+		t.Error("Invalid client-auth: ", lines)
+	}
+
+	go client.Write([]byte(">CLIENT:REAUTH,4,2\r\n" +
+		">CLIENT:ENV,username=alice\r\n" +
+		">CLIENT:ENV,password=wrong\r\n" +
+		">CLIENT:ENV,END\r\n"))
+
+	line := client.readLine()
+	client.Write([]byte("SUCCESS: client-deny command succeeded\r\n"))
+
+	if line != `client-deny 4 2 "bad password" "Wrong \"password\""` {
+		t.Error("Invalid client-deny: ", line)
+	}
+}
+
+func TestDeferredAuth(t *testing.T) {
+	p, client := pipeManagement(t)
+	p.AuthTimeout = time.Millisecond * 100
+
+	deferred := make(chan *PendingAuth, 2)
+	p.Authorizer = AuthorizerFunc(func(req *AuthRequest) AuthResult {
+		deferred <- req.Defer()
+		return Deny("ignored")
+	})
+
+	// Resolved from another goroutine
+	go client.Write([]byte(">CLIENT:CONNECT,7,0\r\n>CLIENT:ENV,username=bob\r\n>CLIENT:ENV,END\r\n"))
+	a := <-deferred
+	if pending := p.PendingAuths(); len(pending) != 1 || pending[0].Username != "bob" {
+		t.Error("Invalid pending auths: ", pending)
+	}
+
+	go a.Resolve(Allow())
+	if line := client.readCommand(); line != "client-auth-nt 7 0" {
+		t.Error("Invalid resolve: ", line)
+	}
+	if err := a.Resolve(Allow()); err != ErrAuthResolved {
+		t.Error("Expected ErrAuthResolved, got: ", err)
+	}
+
+	// Never resolved
+	go client.Write([]byte(">CLIENT:CONNECT,8,0\r\n>CLIENT:ENV,username=eve\r\n>CLIENT:ENV,END\r\n"))
+	<-deferred
+	if line := client.readCommand(); line != `client-deny 8 0 "authentication timed out"` {
+		t.Error("Invalid timeout: ", line)
+	}
+	if pending := p.PendingAuths(); len(pending) != 0 {
+		t.Error("Timed out auth still pending: ", pending)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	p, client := pipeManagement(t)
+
+	p.CredentialProvider = CredentialsFunc(func(req *CredentialRequest) (string, string, error) {
+		if req.Realm == "Private Key" {
+			return "", "key pass", nil
+		}
+		return "alice", `se"cr\et`, nil
+	})
+
+	go client.Write([]byte(">PASSWORD:Need 'Auth' username/password\r\n"))
+	if line := client.readCommand(); line != `username "Auth" "alice"` {
+		t.Error("Invalid username: ", line)
+	}
+	if line := client.readCommand(); line != `password "Auth" "se\"cr\\et"` {
+		t.Error("Invalid password: ", line)
+	}
+
+	go client.Write([]byte(">PASSWORD:Need 'Private Key' password\r\n"))
+	if line := client.readCommand(); line != `password "Private Key" "key pass"` {
+		t.Error("Invalid passphrase: ", line)
+	}
+
+	go client.Write([]byte(">PASSWORD:Verification Failed: 'Auth'\r\n"))
+	select {
+	case e := <-p.TypedEvents:
+		if f, ok := e.(*AuthFailed); !ok || f.Realm != "Auth" {
+			t.Error("Invalid event: ", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("No AuthFailed event")
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	p, client := pipeManagement(t)
+
+	p.CredentialProvider = CredentialsFunc(func(req *CredentialRequest) (string, string, error) {
+		return "alice", "secret", nil
+	})
+	p.ChallengeResponder = ChallengeFunc(func(ch *Challenge) (string, error) {
+		if ch.Static {
+			return "123456", nil
+		}
+		if ch.Text != "Please enter token PIN" || ch.Username != "cr1" || !ch.Echo {
+			t.Error("Invalid dynamic challenge: ", ch)
+		}
+		return "654321", nil
+	})
+
+	// Static challenge
+	go client.Write([]byte(">PASSWORD:Need 'Auth' username/password SC:1,Enter OTP\r\n"))
+	if line := client.readCommand(); line != `username "Auth" "alice"` {
+		t.Error("Invalid username: ", line)
+	}
+	if line := client.readCommand(); line != `password "Auth" "SCRV1:c2VjcmV0:MTIzNDU2"` {
+		t.Error("Invalid static response: ", line)
+	}
+
+	// Dynamic challenge
+	go client.Write([]byte(">PASSWORD:Verification Failed: 'Auth' ['CRV1:R,E:Om01u7Fh4LrGBS7uh0SWmzwabUiGiW6l:Y3Ix:Please enter token PIN']\r\n" +
+		">PASSWORD:Need 'Auth' username/password\r\n"))
+	if line := client.readCommand(); line != `username "Auth" "cr1"` {
+		t.Error("Invalid username: ", line)
+	}
+	if line := client.readCommand(); line != `password "Auth" "CRV1::Om01u7Fh4LrGBS7uh0SWmzwabUiGiW6l::654321"` {
+		t.Error("Invalid dynamic response: ", line)
+	}
+
+	// Server side
+	req := &AuthRequest{Env: map[string]string{"username": "cr1"}}
+	result := req.Challenge("state1", "Enter PIN", false)
+	if result.Allow || result.ClientReason != "CRV1:R:state1:Y3Ix:Enter PIN" {
+		t.Error("Invalid challenge: ", result)
+	}
+
+	req.Env["password"] = "CRV1::state1::4711"
+	if state, response, ok := req.ChallengeResponse(); !ok || state != "state1" || response != "4711" {
+		t.Error("Invalid challenge response: ", state, response, ok)
+	}
+
+	req.Env["password"] = "SCRV1:c2VjcmV0:MTIzNDU2"
+	if password, response, ok := req.StaticChallengeResponse(); !ok || password != "secret" || response != "123456" {
+		t.Error("Invalid static challenge response: ", password, response, ok)
+	}
+}
+
+func TestRunConfig(t *testing.T) {
+	p := NewProcess()
+	p.SetConfig(NewConfig())
+	p.ChallengeResponder = ChallengeFunc(func(ch *Challenge) (string, error) {
+		return "", nil
+	})
+
+	// Added for the challenges, without changing the config of the caller
+	if values := p.runConfig().Values("auth-retry"); len(values) != 1 || values[0][0] != "interact" {
+		t.Error("auth-retry interact was not added: ", values)
+	}
+	if values := p.config.Values("auth-retry"); len(values) != 0 {
+		t.Error("The config of the caller was changed: ", values)
+	}
+
+	// An auth-retry set by the caller is kept
+	p.config.Set("auth-retry", "nointeract")
+	if values := p.runConfig().Values("auth-retry"); len(values) != 1 || values[0][0] != "nointeract" {
+		t.Error("auth-retry was overwritten: ", values)
+	}
+}
+
+type testPrompter struct{}
+
+func (testPrompter) NeedOk(name, message string) bool {
+	return message == "Please insert your cryptographic token"
+}
+func (testPrompter) NeedStr(name, message string) (string, bool) {
+	return "John \"Doe\"", true
+}
+
+func TestPrompts(t *testing.T) {
+	p, client := pipeManagement(t)
+	p.PromptHandler = testPrompter{}
+
+	go client.Write([]byte(">NEED-OK:Need 'token-insertion-request' confirmation MSG:Please insert your cryptographic token\r\n"))
+	if line := client.readCommand(); line != `needok "token-insertion-request" ok` {
+		t.Error("Invalid needok: ", line)
+	}
+
+	go client.Write([]byte(">NEED-STR:Need 'name' input MSG:Please specify your name\r\n"))
+	if line := client.readCommand(); line != `needstr "name" "John \"Doe\""` {
+		t.Error("Invalid needstr: ", line)
+	}
+
+	go client.Write([]byte(">ECHO:1101519562,forget-passwords\r\n"))
+	select {
+	case e := <-p.Echo:
+		if e.Message != "forget-passwords" || e.Since.Unix() != 1101519562 {
+			t.Error("Invalid echo: ", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("No echo received")
+	}
+}
+
+// pipeConn plays openvpn on the other end of a management interface
+type pipeConn struct {
+	net.Conn
+	*textproto.Reader
+	t *testing.T
+}
+
+// pipeManagement connects the management interface of a new client process to
+// an in-memory pipe
+func pipeManagement(t *testing.T) (*Process, *pipeConn) {
+	p := NewProcess()
+	c := NewConfig()
+	c.Remote("localhost", 1194)
+	p.SetConfig(c)
 
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	p.management.connected(server)
+	go p.management.server(server)
+
+	return p, &pipeConn{Conn: client, Reader: textproto.NewReader(bufio.NewReader(client)), t: t}
+}
+
+// readLine reads a line sent by the management interface
+func (c *pipeConn) readLine() string {
+	line, err := c.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return line
+}
+
+// readCommand reads the next command and answers it with SUCCESS
+func (c *pipeConn) readCommand() string {
+	line := c.readLine()
+	c.Write([]byte("SUCCESS: ok\r\n"))
+	return line
+}
+
+// fakeManagement acts as an openvpn management interface protected by a password
+func fakeManagement(l net.Listener, password string) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
 			return
-		case <-done:
-			t.Error("Parse done without result")
+		}
+
+		go func(c net.Conn) {
+			defer c.Close()
+
+			c.Write([]byte("ENTER PASSWORD:"))
+			tp := textproto.NewReader(bufio.NewReader(c))
+			if line, _ := tp.ReadLine(); line != password {
+				c.Write([]byte("ERROR: bad password\r\n"))
+				return
+			}
+			c.Write([]byte("SUCCESS: password is correct\r\n>INFO:OpenVPN Management Interface Version 1 -- type 'help' for more info\r\n"))
+
+			for {
+				line, err := tp.ReadLine()
+				if err != nil {
+					return
+				}
+				switch line {
+				case "pid":
+					c.Write([]byte("SUCCESS: pid=4711\r\n"))
+				case "verb 99":
+					c.Write([]byte("ERROR: verb level is out of range\r\n"))
+				case "status", "status 3":
+					c.Write([]byte("OpenVPN STATISTICS\r\nUpdated,Thu Feb 13 23:39:20 2014\r\nEND\r\n"))
+				default:
+					c.Write([]byte("SUCCESS: ok\r\n"))
+				}
+			}
+		}(c)
+	}
+}
+
+func TestAttach(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fakeManagement(l, "secret")
+
+	if _, err := Attach("tcp", l.Addr().String(), "wrong"); err == nil {
+		t.Error("Attach with the wrong password should fail")
+	}
+
+	p, err := Attach("tcp", l.Addr().String(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	resp, err := p.Command(ctx, "pid")
+	if err != nil || resp.Message != "pid=4711" {
+		t.Error("Invalid pid response: ", resp, err)
+	}
+}
+
+func TestSignal(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// Nothing to signal before openvpn is started
+	if err := NewProcess().Signal(ctx, SIGHUP); err != ErrNotRunning {
+		t.Error("Expected ErrNotRunning, got: ", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fakeManagement(l, "secret")
+
+	p, err := Attach("tcp", l.Addr().String(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.management.Shutdown()
+
+	if err := p.Signal(ctx, SIGUSR1); err != nil {
+		t.Error("Signal failed: ", err)
+	}
+	if err := p.Signal(ctx, Signal("SIGKILL")); err == nil {
+		t.Error("Unknown signals should be rejected")
+	}
+	if err := p.Verb(ctx, 4); err != nil {
+		t.Error("Verb failed: ", err)
+	}
+	if err := p.Verb(ctx, 99); err == nil {
+		t.Error("Expected an error for an invalid verb")
+	}
+	if err := p.Mute(ctx, 20); err != nil {
+		t.Error("Mute failed: ", err)
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	run := func(script string) (*Process, *exec.Cmd, chan error) {
+		p := NewProcess()
+		p.StopTimeout = time.Millisecond * 200
+
+		cmd := exec.Command("sh", "-c", script)
+		stdout, _ := cmd.StdoutPipe()
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for the script to be ready for the signals
+		bufio.NewReader(stdout).ReadString('\n')
+
+		done := make(chan error, 1)
+		go func() {
+			done <- cmd.Wait()
+		}()
+		return p, cmd, done
+	}
+
+	// Without a management interface the OS signal is used
+	p, cmd, done := run("echo ready; exec sleep 10")
+	if method, _ := p.terminate(cmd, done); method != StopSignal {
+		t.Error("Expected the process to be stopped by a signal, got: ", method)
+	}
+
+	// A process ignoring SIGTERM is killed
+	p, cmd, done = run("trap '' TERM; echo ready; exec sleep 10")
+	if method, _ := p.terminate(cmd, done); method != StopKill {
+		t.Error("Expected the process to be killed, got: ", method)
+	}
+
+	// A process that failed to start
+	cmd = exec.Command("/nonexistent/openvpn")
+	cmd.Start()
+	done <- cmd.Wait()
+	if method, err := p.terminate(cmd, done); method != StopExited || err == nil {
+		t.Error("Expected the start error, got: ", method, err)
+	}
+}
+
+// fakeOpenvpn puts an openvpn running the shell script first in PATH
+func fakeOpenvpn(t *testing.T, script string) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/openvpn", []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+}
+
+// supervise runs openvpn under a supervisor until it gives up
+func supervise(t *testing.T) (restarts int, gaveUp *GaveUp) {
+	p := NewProcess()
+	p.SetConfig(NewConfig())
+	p.Management().Transport = &TCPTransport{Address: "127.0.0.1:0"}
+	defer p.management.Shutdown()
+
+	s := NewSupervisor(p)
+	s.MinBackoff = time.Millisecond * 10
+	s.MaxRestarts = 2
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case event := <-p.TypedEvents:
+			switch e := event.(type) {
+			case *Restarting:
+				restarts++
+			case *GaveUp:
+				return restarts, e
+			}
+		case <-timeout:
+			t.Fatal("Timeout waiting for the supervisor to give up")
+		}
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	fakeOpenvpn(t, "exit 1")
+	if restarts, e := supervise(t); restarts != 2 || e.Fatal {
+		t.Error("Expected 2 restarts before giving up, got: ", restarts, e)
+	}
+
+	// Restarting wont fix a broken config
+	fakeOpenvpn(t, "echo 'Options error: Unrecognized option or missing parameter(s)'; exit 1")
+	if restarts, e := supervise(t); restarts != 0 || !e.Fatal {
+		t.Error("Expected to give up without restarting, got: ", restarts, e)
+	}
+}
+
+func TestSupervisorProcessStop(t *testing.T) {
+	fakeOpenvpn(t, "exec sleep 10")
+
+	p := NewProcess()
+	p.SetConfig(NewConfig())
+	p.Management().Transport = &TCPTransport{Address: "127.0.0.1:0"}
+	defer p.management.Shutdown()
+
+	s := NewSupervisor(p)
+	s.MinBackoff = time.Millisecond * 10
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopping the process directly is not a crash
+	p.Stop()
+	select {
+	case <-s.done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("The supervisor did not stop")
+	}
+	for len(p.TypedEvents) > 0 {
+		if e, ok := (<-p.TypedEvents).(*Restarting); ok {
+			t.Error("The process was restarted: ", e)
+		}
+	}
+	s.Stop()
+}
+
+func TestExitStatus(t *testing.T) {
+	fakeOpenvpn(t, "echo starting; echo 'Options error: --dev is missing' >&2; exit 3")
+
+	p := NewProcess()
+	p.SetConfig(NewConfig())
+	p.Management().Transport = &TCPTransport{Address: "127.0.0.1:0"}
+	defer p.management.Shutdown()
+
+	if err := p.Wait(); err != ErrNotRunning {
+		t.Error("Expected ErrNotRunning before start, got: ", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	e, ok := p.Wait().(*ExitError)
+	if !ok {
+		t.Fatal("Expected an ExitError, got: ", p.ExitStatus())
+	}
+	if e.Code != 3 || e.Signal != "" || e.Fatal != "Options error: --dev is missing" {
+		t.Errorf("Invalid exit error: %+v", e)
+	}
+	if len(e.Stdout) != 1 || e.Stdout[0] != "starting" || len(e.Stderr) != 1 {
+		t.Error("Invalid output: ", e.Stdout, e.Stderr)
+	}
+	if e.Error() != "openvpn: exit status 3: Options error: --dev is missing" {
+		t.Error("Invalid message: ", e.Error())
+	}
+}
+
+func TestManager(t *testing.T) {
+	fakeOpenvpn(t, "exec sleep 10")
+
+	m := NewManager()
+	for _, name := range []string{"udp", "tcp"} {
+		p := NewProcess()
+		p.SetConfig(NewConfig())
+		if err := m.Add(name, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Add("udp", NewProcess()); err == nil {
+		t.Error("Duplicate names should be rejected")
+	}
+
+	udp, _ := m.Get("udp")
+	tcp, _ := m.Get("tcp")
+	if udp.Management().Transport.(*UnixTransport).Path == tcp.Management().Transport.(*UnixTransport).Path {
+		t.Error("The instances share a management socket")
+	}
+
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	udp.management.route(&message{kind: "STATE", payload: "1392331160,CONNECTED,SUCCESS,10.8.0.1,"})
+	for _, p := range []*Process{tcp, udp} {
+		p.management.route(&message{kind: "CLIENT", payload: "CONNECT,0,0", env: map[string]string{"common_name": "alice"}})
+		p.management.route(&message{kind: "CLIENT", payload: "ESTABLISHED,0", env: map[string]string{}})
+	}
+
+	if states := m.States(); states["udp"] != "CONNECTED" || states["tcp"] != "" {
+		t.Error("Invalid states: ", states)
+	}
+	if clients := m.ClientsByCommonName("alice"); len(clients) != 2 || clients[0].Instance != "tcp" || clients[1].Instance != "udp" {
+		t.Error("Invalid clients: ", clients)
+	}
+
+	dir := m.RuntimeDir
+	if err := m.Stop(); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("The runtime dir was not removed: ", err)
+	}
+}
+
+func TestManagerStartAgain(t *testing.T) {
+	fakeOpenvpn(t, "exec sleep 10")
+
+	m := NewManager()
+	defer m.Stop()
+	for _, name := range []string{"a", "b"} {
+		p := NewProcess()
+		p.SetConfig(NewConfig())
+		if err := m.Add(name, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// b fails to start, so a is stopped again
+	a, _ := m.Get("a")
+	b, _ := m.Get("b")
+	b.config.Set("verb", "loud")
+	if err := m.Start(); err == nil {
+		t.Fatal("Expected b to fail")
+	}
+	select {
+	case <-a.Stopped:
+	case <-time.After(time.Second * 5):
+		t.Fatal("a was not stopped")
+	}
+
+	b.config.Set("verb", "3")
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-a.Stopped:
+		t.Error("a was stopped after starting again")
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	fakeOpenvpn(t, `test "$1" = --config && cat "$2"; exit 1`)
+
+	p := NewProcess()
+	c := NewConfig()
+	c.Flag(`push "route 10.0.0.0 255.0.0.0"`)
+	p.SetConfig(c)
+	p.Management().Transport = &TCPTransport{Address: "127.0.0.1:0"}
+	defer p.Shutdown()
+
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	e, ok := p.Wait().(*ExitError)
+	if !ok {
+		t.Fatal("Expected an ExitError, got: ", p.ExitStatus())
+	}
+	if len(e.Stdout) == 0 || e.Stdout[0] != `push "route 10.0.0.0 255.0.0.0"` {
+		t.Error("Openvpn was not started with the config file: ", e.Stdout)
+	}
+	if !strings.Contains(strings.Join(e.Stdout, "\n"), "\nmanagement 127.0.0.1 ") {
+		t.Error("The management interface is missing: ", e.Stdout)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := NewSupervisor(NewProcess())
+	s.Jitter = 0
+
+	for failures, expected := range map[int]time.Duration{1: time.Second, 2: time.Second * 2, 4: time.Second * 8, 100: time.Minute} {
+		if delay := s.backoff(failures); delay != expected {
+			t.Error("Wrong backoff after ", failures, " failures: ", delay)
+		}
+	}
+
+	s.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if delay := s.backoff(1); delay < time.Millisecond*800 || delay > time.Millisecond*1200 {
+			t.Error("Jitter out of range: ", delay)
+		}
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	p := NewProcess()
+	c := NewConfig()
+	c.Remote("localhost", 1194)
+	p.SetConfig(c)
+
+	m := p.management
+	m.Transport = &TCPTransport{Address: "127.0.0.1:0"}
+	m.Password = "secret"
+
+	directive, err := m.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Shutdown()
+
+	args := strings.Split(directive, " ")
+	if len(args) != 3 || args[0] != "127.0.0.1" || args[2] != m.passwordFile {
+		t.Fatal("Invalid management directive: ", directive)
+	}
+	if data, err := ioutil.ReadFile(args[2]); err != nil || string(data) != "secret\n" {
+		t.Error("Invalid password file: ", string(data), err)
+	}
+
+	// Connect like openvpn does with management-client and a pw-file
+	conn, err := net.Dial("tcp", args[0]+":"+args[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("ENTER PASSWORD:"))
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	if line, _ := tp.ReadLine(); line != "secret" {
+		t.Fatal("Invalid password: ", line)
+	}
+	conn.Write([]byte("SUCCESS: password is correct\r\n"))
+
+	go func() {
+		if line, _ := tp.ReadLine(); line == "pid" {
+			conn.Write([]byte("SUCCESS: pid=4711\r\n"))
 		}
 	}()
 
-	m.parse([]byte("OpenVPN CLIENT LIST"), false)
-	m.parse([]byte("Updated, Thu Feb 13 23:39:20 2014"), false)
-	m.parse([]byte("Common Name,Real Address,Bytes Received,Bytes Sent,Connected Since"), false)
-	m.parse([]byte("VPN_client,10.13.156.4:1194,12563,14885,Thu Feb 13 23:39:20 2014"), false)
-	m.parse([]byte(""), false)
-	m.parse([]byte("ROUTING TABLE"), false)
-	m.parse([]byte("Virtual Address,Common Name,Real Address,Last Ref"), false)
-	m.parse([]byte("192.168.11.4,VPN_client,10.13.156.4:1194,Thu Feb 13 23:39:20 2014"), false)
-	m.parse([]byte(""), false)
-	m.parse([]byte("GLOBAL STATS"), false)
-	m.parse([]byte("Max bcast/mcast queue length,0"), false)
-	m.parse([]byte("END"), false)
-
-	close(done)
-
-	waitGroup.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// Wait for the connection to be accepted
+	for {
+		resp, err := p.Command(ctx, "pid")
+		if err == ErrNotConnected {
+			time.Sleep(time.Millisecond * 10)
+			continue
+		}
+		if err != nil || resp.Message != "pid=4711" {
+			t.Error("Invalid pid response: ", resp, err)
+		}
+		break
+	}
+}
+
+// statusLines builds a version 1 status reply with the given number of clients
+func statusLines(clients int) []string {
+	lines := []string{
+		"OpenVPN CLIENT LIST",
+		"Updated,Thu Feb 13 23:39:20 2014",
+		"Common Name,Real Address,Bytes Received,Bytes Sent,Connected Since",
+	}
+	for i := 0; i < clients; i++ {
+		lines = append(lines, "client"+strconv.Itoa(i)+",10.13.156.4:"+strconv.Itoa(1024+i)+",12563,14885,Thu Feb 13 23:39:20 2014")
+	}
+	lines = append(lines, "ROUTING TABLE", "Virtual Address,Common Name,Real Address,Last Ref")
+	for i := 0; i < clients; i++ {
+		lines = append(lines, "10.8."+strconv.Itoa(i/250)+"."+strconv.Itoa(i%250+2)+",client"+strconv.Itoa(i)+",10.13.156.4:"+strconv.Itoa(1024+i)+",Thu Feb 13 23:39:20 2014")
+	}
+	return append(lines, "GLOBAL STATS", "Max bcast/mcast queue length,0", "END")
+}
+
+// statusLinesV3 is the reply to "status 3" with the given number of clients
+func statusLinesV3(clients int) []string {
+	lines := []string{
+		"TITLE\tOpenVPN 2.4.4 x86_64-pc-linux-gnu",
+		"TIME\tThu Feb 13 23:39:20 2014\t1392331160",
+		"HEADER\tCLIENT_LIST\tCommon Name\tReal Address\tVirtual Address\tVirtual IPv6 Address\tBytes Received\tBytes Sent\tConnected Since\tConnected Since (time_t)\tUsername\tClient ID\tPeer ID\tData Channel Cipher",
+	}
+	for i := 0; i < clients; i++ {
+		lines = append(lines, "CLIENT_LIST\tclient"+strconv.Itoa(i)+"\t10.13.156.4:"+strconv.Itoa(1024+i)+"\t10.8."+strconv.Itoa(i/250)+"."+strconv.Itoa(i%250+2)+"\t\t12563\t14885\tThu Feb 13 23:39:20 2014\t1392331160\tUNDEF\t"+strconv.Itoa(i)+"\t"+strconv.Itoa(i)+"\tAES-256-GCM")
+	}
+	lines = append(lines, "HEADER\tROUTING_TABLE\tVirtual Address\tCommon Name\tReal Address\tLast Ref\tLast Ref (time_t)")
+	for i := 0; i < clients; i++ {
+		lines = append(lines, "ROUTING_TABLE\t10.8."+strconv.Itoa(i/250)+"."+strconv.Itoa(i%250+2)+"\tclient"+strconv.Itoa(i)+"\t10.13.156.4:"+strconv.Itoa(1024+i)+"\tThu Feb 13 23:39:20 2014\t1392331160")
+	}
+	return append(lines, "GLOBAL_STATS\tMax bcast/mcast queue length\t0", "END")
+}
+
+func BenchmarkParseStatus(b *testing.B) {
+	lines := statusLinesV3(5000)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		p := newParser()
+
+		var msg *message
+		for _, line := range lines {
+			msg = p.feed(line)
+		}
+
+		if status, err := ParseStatus(msg.lines); err != nil || len(status.Clients) != 5000 || len(status.Routes) != 5000 {
+			b.Fatal("Failed to decode the status: ", err)
+		}
+	}
+}
+
+func BenchmarkParseNotifications(b *testing.B) {
+	p := newParser()
+
+	for i := 0; i < b.N; i++ {
+		p.feed(">BYTECOUNT_CLI:" + strconv.Itoa(i%5000) + ",12563,14885")
+	}
+}
+
+func TestManagementStartAgain(t *testing.T) {
+	fakeOpenvpn(t, "exec sleep 10")
+	t.Setenv("TMPDIR", t.TempDir())
+
+	p := NewProcess()
+	p.SetConfig(NewConfig())
+	p.Management().Password = "secret"
+
+	passwordFiles := func() []string {
+		files, _ := filepath.Glob(filepath.Join(os.TempDir(), "openvpn-management-*"))
+		return files
+	}
+
+	var listener net.Listener
+	for i := 0; i < 2; i++ {
+		if err := p.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if listener == nil {
+			listener = p.management.listener
+		} else if p.management.listener != listener {
+			t.Error("A second listener was opened")
+		}
+		if files := passwordFiles(); len(files) != 1 {
+			t.Error("Wrong password files: ", files)
+		}
+		p.Stop()
+	}
+
+	if !strings.HasPrefix(p.management.Path, p.RuntimeDir) {
+		t.Error("The socket is not in the runtime directory: ", p.management.Path)
+	}
+
+	p.Shutdown()
+	if files := passwordFiles(); len(files) != 0 {
+		t.Error("Password files left: ", files)
+	}
+	if p.management.Transport != nil {
+		t.Error("The transport was not reset")
+	}
+}
+
+func TestUnixTransportInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "management.sock")
+
+	l, err := (&UnixTransport{Path: path}).Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&UnixTransport{Path: path}).Listen(); err == nil {
+		t.Error("Expected the socket to be in use")
+	}
+
+	// Left behind by a crashed process
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = (&UnixTransport{Path: path}).Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
 }
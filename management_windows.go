@@ -1,7 +1,15 @@
 package openvpn
 
-func (m *Management) Start() (path string, err error) {
+// Windows has no unix sockets that openvpn can use, so the management
+// interface is reached over tcp on the loopback interface
+func defaultTransport() Transport {
+	return &TCPTransport{
+		Address: "127.0.0.1:0",
+	}
 }
 
-func (m *Management) Shutdown() {
+// instanceTransport is used for the instances of a Manager, every instance
+// gets its own port
+func instanceTransport(dir, name string) Transport {
+	return defaultTransport()
 }
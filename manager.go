@@ -0,0 +1,195 @@
+package openvpn
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Manager runs several named openvpn instances in one program, ex a UDP and
+// a TCP server. Every instance gets its own management socket and config file
+// in a private runtime directory, so they never collide.
+type Manager struct {
+	RuntimeDir string // Created with mode 0700, a temporary directory is used if empty
+
+	processes map[string]*Process
+	tempDir   bool // The runtime dir was created by us and is removed on Stop
+	lock      sync.Mutex
+}
+
+// InstanceClient is a client connected to one of the instances of a Manager
+type InstanceClient struct {
+	Instance string
+	*Client
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		processes: make(map[string]*Process, 0),
+	}
+}
+
+// Add registers a process under a unique name. The management interface is
+// set up to use a socket in the runtime directory, unless a Transport is
+// already configured.
+func (m *Manager) Add(name string, p *Process) error { // {{{
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return errors.New("openvpn: invalid instance name '" + name + "'")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.processes[name]; ok {
+		return errors.New("openvpn: instance '" + name + "' already exists")
+	}
+
+	dir, err := m.runtimeDir()
+	if err != nil {
+		return err
+	}
+
+	if p.management.Transport == nil {
+		p.management.Transport = instanceTransport(dir, name)
+	}
+	if p.RuntimeDir == "" {
+		p.RuntimeDir = filepath.Join(dir, name)
+	}
+	m.processes[name] = p
+	return nil
+} // }}}
+
+// Get returns the process with the name
+func (m *Manager) Get(name string) (*Process, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.processes[name]
+	return p, ok
+}
+
+// Names returns the names of all instances, sorted
+func (m *Manager) Names() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	names := make([]string, 0, len(m.processes))
+	for name := range m.processes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Remove shuts down the instance and forgets about it
+func (m *Manager) Remove(name string) error {
+	m.lock.Lock()
+	p, ok := m.processes[name]
+	delete(m.processes, name)
+	m.lock.Unlock()
+
+	if !ok {
+		return errors.New("openvpn: no instance named '" + name + "'")
+	}
+	return p.Shutdown()
+}
+
+// Start starts all instances. If one fails to start, the ones already
+// started are stopped again.
+func (m *Manager) Start() error { // {{{
+	started := make([]*Process, 0)
+
+	for _, name := range m.Names() {
+		p, _ := m.Get(name)
+		if err := p.Start(); err != nil {
+			for _, p := range started {
+				p.Stop()
+			}
+			return errors.New("openvpn: failed to start '" + name + "': " + err.Error())
+		}
+		started = append(started, p)
+	}
+	return nil
+} // }}}
+
+// Stop shuts down all instances in parallel and removes the runtime directory
+func (m *Manager) Stop() error { // {{{
+	m.lock.Lock()
+	processes := m.processes
+	m.processes = make(map[string]*Process, 0)
+	m.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range processes {
+		wg.Add(1)
+		go func(p *Process) {
+			defer wg.Done()
+			p.Shutdown()
+		}(p)
+	}
+	wg.Wait()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.tempDir {
+		m.tempDir = false
+		dir := m.RuntimeDir
+		m.RuntimeDir = ""
+		return os.RemoveAll(dir)
+	}
+	return nil
+} // }}}
+
+// ClientList returns the clients of all instances, ordered by instance and client ID
+func (m *Manager) ClientList() []InstanceClient {
+	clients := make([]InstanceClient, 0)
+	for _, name := range m.Names() {
+		p, _ := m.Get(name)
+		for _, c := range p.ClientList() {
+			clients = append(clients, InstanceClient{Instance: name, Client: c})
+		}
+	}
+	return clients
+}
+
+// ClientsByCommonName returns the sessions using the common name on any instance
+func (m *Manager) ClientsByCommonName(cn string) []InstanceClient {
+	clients := make([]InstanceClient, 0)
+	for _, name := range m.Names() {
+		p, _ := m.Get(name)
+		for _, c := range p.ClientsByCommonName(cn) {
+			clients = append(clients, InstanceClient{Instance: name, Client: c})
+		}
+	}
+	return clients
+}
+
+// States returns the last state reported by each instance, ex CONNECTED
+func (m *Manager) States() map[string]string {
+	states := make(map[string]string, 0)
+	for _, name := range m.Names() {
+		p, _ := m.Get(name)
+		states[name] = p.State()
+	}
+	return states
+}
+
+// runtimeDir creates the runtime directory if needed, the caller holds the lock
+func (m *Manager) runtimeDir() (string, error) {
+	if m.RuntimeDir == "" {
+		dir, err := ioutil.TempDir("", "openvpn-")
+		if err != nil {
+			return "", err
+		}
+		m.RuntimeDir = dir
+		m.tempDir = true
+		return dir, nil
+	}
+
+	return m.RuntimeDir, os.MkdirAll(m.RuntimeDir, 0700)
+}
@@ -2,44 +2,118 @@ package openvpn
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/cihub/seelog"
 	"github.com/stamp/go-openssl"
 )
 
 type Process struct {
-	StdOut     chan string `json:"-"`
-	StdErr     chan string `json:"-"`
-	Events     chan *Event `json:"-"`
-	Stopped    chan bool   `json:"-"`
-	parameters []string
-	config     *Config
-	Env        map[string]string
-	Clients    map[string]*Client
+	StdOut      chan string       `json:"-"`
+	StdErr      chan string       `json:"-"`
+	Events      chan *Event       `json:"-"`
+	TypedEvents chan TypedEvent   `json:"-"`
+	Echo        chan *EchoMessage `json:"-"`
+	Stopped     chan bool         `json:"-"`
+	parameters  []string
+	config      *Config
+	Env         map[string]string
+
+	// Clients connected to the server by client ID (CID). It is updated from
+	// the management interface, use ClientList and the lookup methods to read
+	// it while the process is running. Sessions are added once they are
+	// authenticated (>CLIENT:ESTABLISHED).
+	Clients        map[string]*Client
+	clientIndex    clientIndex
+	authenticating map[string]*Client // Sessions waiting for the authentication, by CID
+	clientLock     sync.RWMutex
+
+	// BytecountInterval sets how often openvpn reports traffic counters, zero disables the reports
+	BytecountInterval time.Duration
+	// Authorizer, when set, is asked to allow or deny every client that connects
+	Authorizer Authorizer
+	// AuthTimeout is how long a deferred authentication may wait before the client is denied
+	AuthTimeout time.Duration
+	// CredentialProvider, when set, answers openvpn when it asks for usernames, passwords and passphrases
+	CredentialProvider CredentialProvider
+	// ChallengeResponder answers static and dynamic (CRV1) challenges when running as a client
+	ChallengeResponder ChallengeResponder
+	// PromptHandler answers >NEED-OK and >NEED-STR prompts
+	PromptHandler PromptHandler
+	// StopTimeout is how long Stop waits for openvpn to exit before trying harder, see terminate
+	StopTimeout time.Duration
+	// RuntimeDir is where the config file and the management socket are put, a temporary directory is used if empty
+	RuntimeDir string
 
 	management *Management
-
-	shutdown  chan bool
+	eventSeq   uint64
+	logs       *LogBuffer
+
+	traffic Traffic    // Updated from BYTECOUNT notifications when running as a client, see Traffic
+	tempDir bool       // RuntimeDir was created by us and is removed on Shutdown
+	cmd     *exec.Cmd  // The running openvpn, nil when attached
+	exiting chan bool  // Closed when openvpn reports the EXITING state
+	state   string     // The last state reported by openvpn
+	fatal   string     // The last fatal error since openvpn was started
+	exitErr *ExitError // Why openvpn exited, nil while running or after a clean exit
+	lock    sync.Mutex
+
+	// The last lines of output, for ExitError
+	stdoutTail []string
+	stderrTail []string
+
+	// The management Transport was set by Start, and is reset on Shutdown
+	ownTransport bool
+
+	shutdown  chan bool // Closed by Stop, replaced when the process is started again
 	waitGroup sync.WaitGroup
 }
 
 func NewProcess() *Process {
 	p := &Process{
-		Env:     make(map[string]string, 0),
-		Events:  make(chan *Event, 10),
-		Clients: make(map[string]*Client, 0),
+		Env:            make(map[string]string, 0),
+		Events:         make(chan *Event, 10),
+		TypedEvents:    make(chan TypedEvent, 100),
+		Echo:           make(chan *EchoMessage, 10),
+		Clients:        make(map[string]*Client, 0),
+		clientIndex:    newClientIndex(),
+		authenticating: make(map[string]*Client, 0),
+
+		BytecountInterval: time.Second * 5,
+		AuthTimeout:       defaultAuthTimeout,
+		StopTimeout:       defaultStopTimeout,
 
 		shutdown: make(chan bool),
 	}
 
 	p.management = NewManagement(p)
+	p.logs = NewLogBuffer(defaultLogBufferSize)
 
 	return p
 }
 
+// Attach connects to the management interface of an openvpn that is already
+// running, ex started by systemd with "management 127.0.0.1 7505". No child
+// process is started, but events, clients and commands works as usual. The
+// password is only needed when the management interface uses a pw-file.
+func Attach(network, address, password string) (*Process, error) {
+	p := NewProcess()
+	p.management.Password = password
+
+	if err := p.management.Dial(network, address); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
 // Short-hands for some basic openvpn operating modes
 
 func NewSslServer(ca *openssl.CA, cert *openssl.Cert, dh *openssl.DH, ta *openssl.TA, configFile string) *Process { // {{{
@@ -144,7 +218,78 @@ func (p *Process) SetConfig(c *Config) {
 	p.config = c
 }
 
+// Management returns the management interface of the process, configure its
+// Transport and Password before calling Start
+func (p *Process) Management() *Management {
+	return p.management
+}
+
+// runtimeDir returns the runtime directory, creating it if needed
+func (p *Process) runtimeDir() (string, error) { // {{{
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.RuntimeDir == "" {
+		dir, err := ioutil.TempDir("", "openvpn-")
+		if err != nil {
+			return "", err
+		}
+		p.RuntimeDir = dir
+		p.tempDir = true
+	} else if err := os.MkdirAll(p.RuntimeDir, 0700); err != nil {
+		return "", err
+	}
+	return p.RuntimeDir, nil
+} // }}}
+
+// writeConfig renders the config to openvpn.conf in the runtime directory
+func (p *Process) writeConfig(c *Config) (string, error) {
+	dir, err := p.runtimeDir()
+	if err != nil {
+		return "", err
+	}
+
+	filename := filepath.Join(dir, "openvpn.conf")
+	return filename, c.WriteFile(filename)
+}
+
+// runConfig is the config openvpn is started with. Options needed by the
+// callbacks are added to a copy, leaving the config of the caller alone.
+func (p *Process) runConfig() *Config {
+	c := p.config.copy()
+	if p.ChallengeResponder != nil && len(c.Values("auth-retry")) == 0 {
+		// Dynamic challenges needs openvpn to ask for credentials again after a failure
+		c.set("auth-retry", "interact")
+	}
+	return c
+}
+
+// State returns the last state reported by openvpn, ex CONNECTED
+func (p *Process) State() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.state
+}
+
+// Traffic returns the counters from the last BYTECOUNT notification when running as a client
+func (p *Process) Traffic() Traffic {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.traffic
+}
+
+// Command sends a command to the openvpn management interface and waits for the reply
+func (p *Process) Command(ctx context.Context, cmd string) (Response, error) {
+	return p.management.Command(ctx, cmd)
+}
+
 func (p *Process) Start() (err error) { // {{{
+	if p.config == nil {
+		return fmt.Errorf("Openvpn has no config, aborting")
+	}
+
 	// Check if the process is already running
 	if p.Stopped != nil {
 		select {
@@ -155,19 +300,51 @@ func (p *Process) Start() (err error) { // {{{
 		}
 	}
 
+	// A stopped process can be started again
+	p.lock.Lock()
+	select {
+	case <-p.shutdown:
+		p.shutdown = make(chan bool)
+	default:
+	}
+	p.lock.Unlock()
+
+	// Every process gets its own socket in the runtime directory
+	if p.management.Transport == nil {
+		dir, err := p.runtimeDir()
+		if err != nil {
+			return err
+		}
+		p.management.Transport = instanceTransport(dir, "management")
+		p.ownTransport = true
+	}
+
 	// Start the management interface (if it isnt already started)
-	path, err := p.management.Start()
+	directive, err := p.management.Start()
 	if err != nil {
 		return err
 	}
 
 	// Add the management interface path to the config
-	p.config.setManagementPath(path)
+	flags := make([]string, 0)
+	if p.Authorizer != nil {
+		flags = append(flags, "management-client-auth")
+	}
+	if p.CredentialProvider != nil {
+		flags = append(flags, "management-query-passwords")
+	}
+	p.config.setManagementPath(directive, flags...)
 
 	return p.Restart()
 }                                      // }}}
 func (p *Process) Stop() (err error) { // {{{
-	close(p.shutdown)
+	p.lock.Lock()
+	select {
+	case <-p.shutdown:
+	default:
+		close(p.shutdown)
+	}
+	p.lock.Unlock()
 	p.waitGroup.Wait()
 
 	return
@@ -176,15 +353,37 @@ func (p *Process) Shutdown() (err error) { // {{{
 	p.Stop()
 	p.management.Shutdown()
 
+	p.lock.Lock()
+	if p.ownTransport {
+		// The socket was in the runtime directory
+		p.management.Transport = nil
+		p.ownTransport = false
+	}
+	if p.tempDir {
+		os.RemoveAll(p.RuntimeDir)
+		p.RuntimeDir = ""
+		p.tempDir = false
+	}
+	p.lock.Unlock()
+
 	return
 }                                         // }}}
 func (p *Process) Restart() (err error) { // {{{
 	// Fetch the current config
-	config, err := p.config.Validate()
+	c := p.runConfig()
+	config, err := c.Validate()
 	if err != nil {
 		return err
 	}
 
+	if !c.Argv {
+		filename, err := p.writeConfig(c)
+		if err != nil {
+			return err
+		}
+		config = []string{"--config", filename}
+	}
+
 	// Create the command
 	cmd := exec.Command("openvpn", config...)
 
@@ -199,6 +398,10 @@ func (p *Process) Restart() (err error) { // {{{
 		return err
 	}
 
+	p.lock.Lock()
+	p.cmd = cmd
+	p.lock.Unlock()
+
 	return
 } // }}}
 
@@ -212,16 +415,33 @@ func (p *Process) Fire(name string, args ...string) { // {{{
 		log.Warn("Lost event: ", name, " args:", args)
 	}
 } // }}}
+func (p *Process) emit(e TypedEvent) { // {{{
+	e.stamp(atomic.AddUint64(&p.eventSeq, 1), time.Now())
+
+	select {
+	case p.TypedEvents <- e:
+	default:
+		log.Warnf("Lost event: %T %+v", e, e)
+	}
+} // }}}
 
 func (p *Process) ProcessMonitor(cmd *exec.Cmd, release chan bool) { // {{{
 
-	p.stdoutMonitor(cmd)
-	p.stderrMonitor(cmd)
+	stdout := p.stdoutMonitor(cmd)
+	stderr := p.stderrMonitor(cmd)
 
+	p.lock.Lock()
+	shutdown := p.shutdown
 	p.Stopped = make(chan bool)
-
+	p.exiting = make(chan bool)
+	p.fatal = ""
+	p.exitErr = nil
+	p.stdoutTail = nil
+	p.stderrTail = nil
+	p.lock.Unlock()
+
+	p.waitGroup.Add(1)
 	go func() {
-		p.waitGroup.Add(1)
 		defer p.waitGroup.Done()
 
 		defer close(p.Stopped)
@@ -230,33 +450,48 @@ func (p *Process) ProcessMonitor(cmd *exec.Cmd, release chan bool) { // {{{
 		done := make(chan error)
 		go func() {
 			<-release // Wait for the process to start
+
+			// All output must be read before Wait closes the pipes, or the
+			// last lines (often the reason openvpn exited) are lost
+			<-stdout
+			<-stderr
 			done <- cmd.Wait()
 		}()
 
 		// Wait for shutdown or exit
 		select {
-		case <-p.shutdown:
-			// Kill the server
-			if err := cmd.Process.Kill(); err != nil {
-				return
-			}
-			err := <-done // allow goroutine to exit
-			log.Error("process killed with error = ", err)
+		case <-shutdown:
+			<-release // Restart is done with cmd, it is started or failed to
+			method, err := p.terminate(cmd, done)
+			log.Info("process stopped (", method, ") with error = ", err)
+			p.setExitError(err)
+			p.emit(&ProcessStopped{Method: method, Err: err})
 		case err := <-done:
 			log.Error("process done with error = ", err)
+			p.setExitError(err)
 			return
 		}
 
 	}()
 }                                                // }}}
-func (p *Process) stdoutMonitor(cmd *exec.Cmd) { // {{{
+func (p *Process) stdoutMonitor(cmd *exec.Cmd) chan bool { // {{{
 	stdout, _ := cmd.StdoutPipe()
+	eof := make(chan bool)
+	p.waitGroup.Add(1)
 	go func() {
-		p.waitGroup.Add(1)
 		defer p.waitGroup.Done()
+		defer close(eof)
 
 		scanner := bufio.NewScanner(stdout)
 		for scanner.Scan() {
+			p.addOutput(&p.stdoutTail, scanner.Text())
+			if !p.management.isLogging() {
+				p.logs.add(parseOutputLine(scanner.Text(), "stdout"))
+			}
+			if isFatal(scanner.Text()) {
+				p.setFatal(scanner.Text())
+			}
+
 			select {
 			case p.StdOut <- scanner.Text():
 			default:
@@ -269,15 +504,24 @@ func (p *Process) stdoutMonitor(cmd *exec.Cmd) { // {{{
 			return
 		}
 	}()
+	return eof
 }                                                // }}}
-func (p *Process) stderrMonitor(cmd *exec.Cmd) { // {{{
+func (p *Process) stderrMonitor(cmd *exec.Cmd) chan bool { // {{{
 	stderr, _ := cmd.StderrPipe()
+	eof := make(chan bool)
+	p.waitGroup.Add(1)
 	go func() {
-		p.waitGroup.Add(1)
 		defer p.waitGroup.Done()
+		defer close(eof)
 
 		scanner := bufio.NewScanner(stderr)
 		for scanner.Scan() {
+			p.addOutput(&p.stderrTail, scanner.Text())
+			p.logs.add(parseOutputLine(scanner.Text(), "stderr"))
+			if isFatal(scanner.Text()) {
+				p.setFatal(scanner.Text())
+			}
+
 			select {
 			case p.StdErr <- scanner.Text():
 			default:
@@ -289,4 +533,25 @@ func (p *Process) stderrMonitor(cmd *exec.Cmd) { // {{{
 			return
 		}
 	}()
+	return eof
 } // }}}
+
+func (p *Process) setFatal(msg string) {
+	p.lock.Lock()
+	p.fatal = msg
+	p.lock.Unlock()
+}
+
+// fatalMessage returns the last fatal error since openvpn was started
+func (p *Process) fatalMessage() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.fatal
+}
+
+func (p *Process) setExitError(err error) {
+	p.lock.Lock()
+	p.exitErr = p.newExitError(err)
+	p.lock.Unlock()
+}
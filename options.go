@@ -0,0 +1,438 @@
+package openvpn
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+// argType describes what an argument of an option must look like
+type argType int
+
+const (
+	argAny   argType = iota
+	argInt           // A number
+	argPort          // 1-65535
+	argIP            // An IPv4 or IPv6 address, or a netmask
+	argProto         // udp, tcp, ...
+	argDir           // Key direction, 0 or 1
+)
+
+// Where an option can be used
+const (
+	anyMode = iota
+	clientOnly
+	serverOnly
+)
+
+// option describes a directive openvpn knows about
+type option struct {
+	min, max   int       // Number of arguments, max -1 for any number
+	types      []argType // Type of each argument, missing ones are argAny
+	oneOf      []string  // Allowed values of the first argument
+	mode       int       // anyMode, clientOnly or serverOnly
+	excludes   []string  // Options that can't be used together with this one
+	deprecated string    // What to use instead, logged as a warning
+	connection bool      // Allowed within <connection> blocks
+}
+
+var protocols = []string{"udp", "tcp", "udp4", "tcp4", "udp6", "tcp6", "tcp-server", "tcp-client", "tcp4-server", "tcp4-client", "tcp6-server", "tcp6-client"}
+
+// optionCatalog lists the options of openvpn 2.4 and 2.5 that this library
+// validates. Options missing here are only warned about, unless Config.Strict
+// is set.
+var optionCatalog = map[string]option{
+	// General
+	"config":                 {min: 1, max: 1},
+	"mode":                   {min: 1, max: 1, oneOf: []string{"p2p", "server"}},
+	"dev":                    {min: 1, max: 1},
+	"dev-type":               {min: 1, max: 1, oneOf: []string{"tun", "tap"}},
+	"dev-node":               {min: 1, max: 1},
+	"topology":               {min: 1, max: 1, oneOf: []string{"net30", "p2p", "subnet"}},
+	"proto":                  {min: 1, max: 1, oneOf: protocols, connection: true},
+	"port":                   {min: 1, max: 1, types: []argType{argPort}, connection: true},
+	"lport":                  {min: 1, max: 1, types: []argType{argPort}, connection: true},
+	"rport":                  {min: 1, max: 1, types: []argType{argPort}, connection: true},
+	"local":                  {min: 1, max: 1, connection: true},
+	"remote":                 {min: 1, max: 3, types: []argType{argAny, argPort, argProto}, connection: true},
+	"remote-random":          {},
+	"remote-random-hostname": {},
+	"resolv-retry":           {min: 1, max: 1},
+	"float":                  {connection: true},
+	"bind":                   {max: 1, connection: true},
+	"nobind":                 {connection: true},
+	"connect-retry":          {min: 1, max: 2, types: []argType{argInt, argInt}, connection: true},
+	"connect-retry-max":      {min: 1, max: 1, types: []argType{argInt}, connection: true},
+	"connect-timeout":        {min: 1, max: 1, types: []argType{argInt}, connection: true},
+	"http-proxy":             {min: 2, max: 4, types: []argType{argAny, argPort}, connection: true},
+	"http-proxy-user-pass":   {max: 1},
+	"http-proxy-option":      {min: 1, max: 3, connection: true},
+	"socks-proxy":            {min: 1, max: 3, types: []argType{argAny, argPort}, connection: true},
+	"explicit-exit-notify":   {max: 1, types: []argType{argInt}, connection: true},
+	"ifconfig":               {min: 2, max: 2, types: []argType{argIP, argIP}},
+	"ifconfig-ipv6":          {min: 2, max: 2},
+	"ifconfig-noexec":        {},
+	"ifconfig-nowarn":        {},
+	"route":                  {min: 1, max: 4, types: []argType{argAny, argIP, argAny, argInt}},
+	"route-ipv6":             {min: 1, max: 3},
+	"route-gateway":          {min: 1, max: 1},
+	"route-metric":           {min: 1, max: 1, types: []argType{argInt}},
+	"route-delay":            {max: 2, types: []argType{argInt, argInt}},
+	"route-noexec":           {},
+	"route-nopull":           {mode: clientOnly},
+	"redirect-gateway":       {max: -1},
+	"keepalive":              {min: 2, max: 2, types: []argType{argInt, argInt}},
+	"ping":                   {min: 1, max: 1, types: []argType{argInt}},
+	"ping-restart":           {min: 1, max: 1, types: []argType{argInt}},
+	"ping-exit":              {min: 1, max: 1, types: []argType{argInt}},
+	"ping-timer-rem":         {},
+	"inactive":               {min: 1, max: 2, types: []argType{argInt, argInt}},
+	"persist-tun":            {},
+	"persist-key":            {},
+	"persist-local-ip":       {},
+	"persist-remote-ip":      {},
+	"user":                   {min: 1, max: 1},
+	"group":                  {min: 1, max: 1},
+	"chroot":                 {min: 1, max: 1},
+	"cd":                     {min: 1, max: 1},
+	"daemon":                 {max: 1},
+	"writepid":               {min: 1, max: 1},
+	"nice":                   {min: 1, max: 1, types: []argType{argInt}},
+	"tun-ipv6":               {},
+	"bind-dev":               {min: 1, max: 1},
+	"socket-flags":           {min: 1, max: -1},
+	"mlock":                  {},
+	"disable-occ":            {},
+	"single-session":         {},
+	"shaper":                 {min: 1, max: 1, types: []argType{argInt}},
+	"client-nat":             {min: 4, max: 4, types: []argType{argAny, argIP, argIP, argIP}, oneOf: []string{"snat", "dnat"}},
+	"tun-mtu":                {min: 1, max: 1, types: []argType{argInt}, connection: true},
+	"tun-mtu-extra":          {min: 1, max: 1, types: []argType{argInt}, connection: true},
+	"link-mtu":               {min: 1, max: 1, types: []argType{argInt}, connection: true},
+	"mssfix":                 {max: 1, types: []argType{argInt}, connection: true},
+	"fragment":               {min: 1, max: 1, types: []argType{argInt}, connection: true},
+	"mtu-disc":               {min: 1, max: 1, oneOf: []string{"no", "maybe", "yes"}},
+	"sndbuf":                 {min: 1, max: 1, types: []argType{argInt}},
+	"rcvbuf":                 {min: 1, max: 1, types: []argType{argInt}},
+	"txqueuelen":             {min: 1, max: 1, types: []argType{argInt}},
+	"fast-io":                {},
+	"script-security":        {min: 1, max: 1, oneOf: []string{"0", "1", "2", "3"}},
+	"up":                     {min: 1, max: 1},
+	"down":                   {min: 1, max: 1},
+	"up-delay":               {},
+	"down-pre":               {},
+	"up-restart":             {},
+	"route-up":               {min: 1, max: 1},
+	"route-pre-down":         {min: 1, max: 1},
+	"ipchange":               {min: 1, max: 1},
+	"setenv":                 {min: 1, max: 2},
+	"setenv-safe":            {min: 1, max: 2},
+	"ignore-unknown-option":  {min: 1, max: -1},
+	"allow-compression":      {min: 1, max: 1, oneOf: []string{"yes", "no", "asym"}},
+	"compress":               {max: 1, oneOf: []string{"lzo", "lz4", "lz4-v2", "stub", "stub-v2"}},
+	"comp-lzo":               {max: 1, oneOf: []string{"yes", "no", "adaptive"}, deprecated: "compress"},
+	"comp-noadapt":           {deprecated: "compress"},
+
+	// Logging
+	"log":                     {min: 1, max: 1},
+	"log-append":              {min: 1, max: 1},
+	"syslog":                  {max: 1},
+	"status":                  {min: 1, max: 2, types: []argType{argAny, argInt}},
+	"status-version":          {min: 1, max: 1, oneOf: []string{"1", "2", "3"}},
+	"verb":                    {min: 1, max: 1, types: []argType{argInt}},
+	"mute":                    {min: 1, max: 1, types: []argType{argInt}},
+	"mute-replay-warnings":    {},
+	"suppress-timestamps":     {},
+	"machine-readable-output": {},
+
+	// Management interface
+	"management":                   {min: 2, max: 3},
+	"management-client":            {},
+	"management-hold":              {},
+	"management-signal":            {},
+	"management-up-down":           {},
+	"management-query-passwords":   {},
+	"management-query-proxy":       {},
+	"management-query-remote":      {},
+	"management-forget-disconnect": {},
+	"management-log-cache":         {min: 1, max: 1, types: []argType{argInt}},
+	"management-client-auth":       {mode: serverOnly},
+	"management-client-pf":         {mode: serverOnly},
+	"management-client-user":       {min: 1, max: 1},
+	"management-client-group":      {min: 1, max: 1},
+	"management-external-key":      {max: -1},
+	"management-external-cert":     {min: 1, max: 1},
+
+	// Crypto
+	"secret":                {min: 1, max: 2, types: []argType{argAny, argDir}, excludes: []string{"tls-server", "tls-client", "client", "server", "server-bridge"}},
+	"cipher":                {min: 1, max: 1},
+	"data-ciphers":          {min: 1, max: 1},
+	"data-ciphers-fallback": {min: 1, max: 1},
+	"ncp-ciphers":           {min: 1, max: 1, deprecated: "data-ciphers"},
+	"ncp-disable":           {deprecated: "data-ciphers"},
+	"auth":                  {min: 1, max: 1},
+	"keysize":               {min: 1, max: 1, types: []argType{argInt}, deprecated: "cipher"},
+	"engine":                {max: 1},
+	"no-replay":             {deprecated: "the default replay protection"},
+	"replay-window":         {min: 1, max: 2, types: []argType{argInt, argInt}},
+	"key-direction":         {min: 1, max: 1, types: []argType{argDir}},
+	"tls-server":            {excludes: []string{"tls-client"}},
+	"tls-client":            {},
+	"ca":                    {min: 1, max: 1},
+	"capath":                {min: 1, max: 1},
+	"cert":                  {min: 1, max: 1},
+	"extra-certs":           {min: 1, max: 1},
+	"key":                   {min: 1, max: 1},
+	"pkcs12":                {min: 1, max: 1},
+	"dh":                    {min: 1, max: 1},
+	"ecdh-curve":            {min: 1, max: 1},
+	"tls-auth":              {min: 1, max: 2, types: []argType{argAny, argDir}, excludes: []string{"tls-crypt", "tls-crypt-v2"}},
+	"tls-crypt":             {min: 1, max: 1, excludes: []string{"tls-crypt-v2"}},
+	"tls-crypt-v2":          {min: 1, max: 2},
+	"tls-version-min":       {min: 1, max: 2},
+	"tls-version-max":       {min: 1, max: 1},
+	"tls-cipher":            {min: 1, max: 1},
+	"tls-ciphersuites":      {min: 1, max: 1},
+	"tls-timeout":           {min: 1, max: 1, types: []argType{argInt}},
+	"hand-window":           {min: 1, max: 1, types: []argType{argInt}},
+	"tran-window":           {min: 1, max: 1, types: []argType{argInt}},
+	"reneg-sec":             {min: 1, max: 2, types: []argType{argInt, argInt}},
+	"reneg-bytes":           {min: 1, max: 1, types: []argType{argInt}},
+	"reneg-pkts":            {min: 1, max: 1, types: []argType{argInt}},
+	"crl-verify":            {min: 1, max: 2},
+	"verify-x509-name":      {min: 1, max: 2},
+	"remote-cert-tls":       {min: 1, max: 1, oneOf: []string{"client", "server"}},
+	"remote-cert-ku":        {max: -1},
+	"remote-cert-eku":       {min: 1, max: 1},
+	"ns-cert-type":          {min: 1, max: 1, oneOf: []string{"client", "server"}, deprecated: "remote-cert-tls"},
+	"tls-remote":            {min: 1, max: 1, deprecated: "verify-x509-name"},
+	"verify-hash":           {min: 1, max: 2},
+	"peer-fingerprint":      {max: 1},
+	"x509-track":            {min: 1, max: 1},
+	"tls-exit":              {},
+	"tls-verify":            {min: 1, max: 1},
+	"tls-export-cert":       {min: 1, max: 1},
+	"x509-username-field":   {min: 1, max: -1},
+	"auth-nocache":          {},
+	"auth-token":            {min: 1, max: 1},
+	"askpass":               {max: 1},
+	"key-method":            {min: 1, max: 1, oneOf: []string{"2"}, deprecated: "the default key method"},
+
+	// Client
+	"client":              {excludes: []string{"server", "server-bridge"}},
+	"pull":                {mode: clientOnly},
+	"pull-filter":         {min: 2, max: 2, oneOf: []string{"accept", "ignore", "reject"}, mode: clientOnly},
+	"auth-user-pass":      {max: 1, mode: clientOnly},
+	"auth-retry":          {min: 1, max: 1, oneOf: []string{"none", "nointeract", "interact"}, mode: clientOnly},
+	"static-challenge":    {min: 2, max: 2, types: []argType{argAny, argDir}, mode: clientOnly},
+	"dhcp-option":         {min: 1, max: 2},
+	"block-outside-dns":   {},
+	"register-dns":        {},
+	"route-method":        {min: 1, max: 1, oneOf: []string{"adaptive", "ipapi", "exe"}},
+	"ip-win32":            {min: 1, max: 3},
+	"tap-sleep":           {min: 1, max: 1, types: []argType{argInt}},
+	"allow-pull-fqdn":     {},
+	"server-poll-timeout": {min: 1, max: 1, types: []argType{argInt}},
+	"block-ipv6":          {},
+
+	// Server
+	"server":                   {min: 2, max: 3, types: []argType{argIP, argIP}, mode: serverOnly},
+	"server-ipv6":              {min: 1, max: 1, mode: serverOnly},
+	"server-bridge":            {max: 4, mode: serverOnly},
+	"push":                     {min: 1, max: 1, mode: serverOnly},
+	"push-reset":               {mode: serverOnly},
+	"push-remove":              {min: 1, max: 1, mode: serverOnly},
+	"push-peer-info":           {},
+	"ifconfig-pool":            {min: 2, max: 3, types: []argType{argIP, argIP, argIP}, mode: serverOnly},
+	"ifconfig-pool-persist":    {min: 1, max: 2, types: []argType{argAny, argInt}, mode: serverOnly},
+	"ifconfig-ipv6-pool":       {min: 1, max: 1, mode: serverOnly},
+	"ifconfig-push":            {min: 2, max: 3, types: []argType{argIP, argIP}, mode: serverOnly},
+	"iroute":                   {min: 1, max: 2, types: []argType{argIP, argIP}, mode: serverOnly},
+	"client-to-client":         {mode: serverOnly},
+	"duplicate-cn":             {mode: serverOnly},
+	"client-config-dir":        {min: 1, max: 1, mode: serverOnly},
+	"ccd-exclusive":            {mode: serverOnly},
+	"max-clients":              {min: 1, max: 1, types: []argType{argInt}, mode: serverOnly},
+	"max-routes-per-client":    {min: 1, max: 1, types: []argType{argInt}, mode: serverOnly},
+	"connect-freq":             {min: 2, max: 2, types: []argType{argInt, argInt}, mode: serverOnly},
+	"learn-address":            {min: 1, max: 1, mode: serverOnly},
+	"client-connect":           {min: 1, max: 1, mode: serverOnly},
+	"client-disconnect":        {min: 1, max: 1, mode: serverOnly},
+	"auth-user-pass-verify":    {min: 2, max: 2, oneOf: nil, mode: serverOnly},
+	"auth-gen-token":           {max: 2, mode: serverOnly},
+	"auth-user-pass-optional":  {mode: serverOnly},
+	"username-as-common-name":  {mode: serverOnly},
+	"verify-client-cert":       {min: 1, max: 1, oneOf: []string{"none", "optional", "require"}, mode: serverOnly},
+	"client-cert-not-required": {mode: serverOnly, deprecated: "verify-client-cert none"},
+	"opt-verify":               {mode: serverOnly},
+	"tmp-dir":                  {min: 1, max: 1},
+	"hash-size":                {min: 2, max: 2, types: []argType{argInt, argInt}, mode: serverOnly},
+	"bcast-buffers":            {min: 1, max: 1, types: []argType{argInt}, mode: serverOnly},
+	"tcp-queue-limit":          {min: 1, max: 1, types: []argType{argInt}, mode: serverOnly},
+	"stale-routes-check":       {min: 1, max: 2, types: []argType{argInt, argInt}, mode: serverOnly},
+	"port-share":               {min: 2, max: 3, types: []argType{argAny, argPort}, mode: serverOnly},
+	"plugin":                   {min: 1, max: -1},
+}
+
+// ConfigError is a problem with one option
+type ConfigError struct {
+	Key     string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return e.Key + ": " + e.Message
+}
+
+// ConfigErrors is returned from Config.Validate and lists every problem found
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return "openvpn: invalid config: " + strings.Join(lines, "; ")
+}
+
+// mode guesses if the config is for a client or a server
+func (c *Config) mode() int {
+	mode := anyMode
+	for _, d := range c.directives {
+		switch {
+		case d.name == "client" || d.name == "pull":
+			mode = clientOnly
+		case d.name == "server" || d.name == "server-bridge" || (d.name == "mode" && len(d.args) > 0 && d.args[0] == "server"):
+			return serverOnly
+		}
+	}
+	return mode
+}
+
+// validate checks every directive against the option catalog
+func (c *Config) validate(mode int, strict bool) ConfigErrors { // {{{
+	errs := make(ConfigErrors, 0)
+	add := func(key, message string) {
+		errs = append(errs, &ConfigError{Key: key, Message: message})
+	}
+
+	present := make(map[string]bool, len(c.directives))
+	ignored := make(map[string]bool, 0)
+	for _, d := range c.directives {
+		present[d.name] = true
+		if d.name == "ignore-unknown-option" {
+			for _, name := range d.args {
+				ignored[name] = true
+			}
+		}
+	}
+
+	for _, d := range c.directives {
+		if d.block != nil {
+			if d.name != "connection" {
+				add(d.name, "unknown block")
+				continue
+			}
+
+			for _, e := range d.block.validate(mode, strict) {
+				add("connection/"+e.Key, e.Message)
+			}
+			for _, b := range d.block.directives {
+				if o, ok := optionCatalog[b.name]; ok && !o.connection {
+					add("connection/"+b.name, "not allowed in a <connection> block")
+				}
+			}
+			continue
+		}
+
+		o, ok := optionCatalog[d.name]
+		if !ok {
+			switch {
+			case ignored[d.name]:
+			case strict:
+				add(d.name, "unknown option")
+			default:
+				log.Warn("Config: unknown option ", d.name)
+			}
+			continue
+		}
+
+		if d.inline == "" {
+			validateArgs(d, o, add)
+		}
+
+		switch {
+		case o.mode == clientOnly && mode == serverOnly:
+			add(d.name, "can only be used by a client")
+		case o.mode == serverOnly && mode == clientOnly:
+			add(d.name, "can only be used by a server")
+		}
+
+		for _, other := range o.excludes {
+			if present[other] {
+				add(d.name, "can't be used together with "+other)
+			}
+		}
+
+		if o.deprecated != "" {
+			log.Warn("Config: ", d.name, " is deprecated, use ", o.deprecated, " instead")
+		}
+	}
+
+	return errs
+} // }}}
+
+func validateArgs(d directive, o option, add func(key, message string)) { // {{{
+	if len(d.args) < o.min || (o.max >= 0 && len(d.args) > o.max) {
+		expected := strconv.Itoa(o.min)
+		switch {
+		case o.max < 0:
+			expected = "at least " + expected
+		case o.max != o.min:
+			expected += "-" + strconv.Itoa(o.max)
+		}
+		add(d.name, "expected "+expected+" arguments, got "+strconv.Itoa(len(d.args)))
+		return
+	}
+
+	if len(o.oneOf) > 0 && len(d.args) > 0 && !contains(o.oneOf, d.args[0]) {
+		add(d.name, "invalid value '"+d.args[0]+"', expected one of "+strings.Join(o.oneOf, ", "))
+	}
+
+	for i, arg := range d.args {
+		if i >= len(o.types) {
+			break
+		}
+
+		valid := true
+		switch o.types[i] {
+		case argInt:
+			_, err := strconv.Atoi(arg)
+			valid = err == nil
+		case argPort:
+			port, err := strconv.Atoi(arg)
+			valid = err == nil && port >= 0 && port <= 65535
+		case argIP:
+			valid = net.ParseIP(arg) != nil
+		case argProto:
+			valid = contains(protocols, arg)
+		case argDir:
+			valid = arg == "0" || arg == "1"
+		}
+
+		if !valid {
+			add(d.name, "invalid argument '"+arg+"'")
+		}
+	}
+} // }}}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package openvpn
+
+import (
+	"bufio"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+// Limits protecting us from a misbehaving management interface
+const (
+	maxLineLength = 64 * 1024        // Longest line accepted from openvpn
+	maxBlockLines = 1024 * 1024      // Longest multi-line reply, status for ~100k clients
+	maxBlockBytes = 64 * 1024 * 1024 // Largest multi-line reply
+	maxClientEnv  = 1024             // Largest >CLIENT:ENV block
+)
+
+// readLine reads a line without the line break. Lines longer than
+// maxLineLength are cut, the rest is thrown away and truncated is set.
+func readLine(r *bufio.Reader) (line string, truncated bool, err error) { // {{{
+	buf := make([]byte, 0, 128)
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", false, err
+		}
+
+		if len(buf)+len(chunk) <= maxLineLength {
+			buf = append(buf, chunk...)
+		} else {
+			truncated = true
+		}
+
+		if !isPrefix {
+			return string(buf), truncated, nil
+		}
+	}
+} // }}}
+
+// message is a complete unit received from the management interface, either a
+// real-time notification or the reply to a command
+type message struct {
+	// Real-time notifications, ex >STATE:1392331160,CONNECTED,SUCCESS,...
+	kind    string // STATE, LOG, CLIENT, ... or empty for command replies
+	payload string // The text following >TYPE:
+
+	// Client notifications are followed by an environment block (>CLIENT:ENV),
+	// which is collected before the message is delivered
+	env map[string]string
+
+	// Command replies
+	status string   // SUCCESS, ERROR or empty for multi-line replies
+	lines  []string // The lines of a multi-line reply, without END
+}
+
+// parser splits the line stream from openvpn into messages. Notifications
+// starts with > and may be interleaved with the lines of a multi-line reply.
+// Lines that isnt a notification is part of a reply, either a single SUCCESS:
+// or ERROR: line or a block terminated by END.
+type parser struct {
+	block     []string
+	blockSize int
+	overflow  bool // The current block is too large and is being thrown away
+
+	client *message // The client notification waiting for its ENV block
+}
+
+func newParser() *parser {
+	return &parser{}
+}
+
+// feed parses one line, a message is returned when it is complete
+func (p *parser) feed(line string) *message { // {{{
+	if strings.HasPrefix(line, ">") {
+		return p.notification(line[1:])
+	}
+
+	if len(p.block) == 0 && !p.overflow {
+		switch {
+		case strings.HasPrefix(line, "SUCCESS:"):
+			return &message{status: "SUCCESS", payload: strings.TrimSpace(line[len("SUCCESS:"):])}
+		case strings.HasPrefix(line, "ERROR:"):
+			return &message{status: "ERROR", payload: strings.TrimSpace(line[len("ERROR:"):])}
+		}
+	}
+
+	if line == "END" {
+		if p.overflow {
+			p.overflow = false
+			return &message{status: "ERROR", payload: "reply too large"}
+		}
+
+		msg := &message{lines: p.block}
+		p.block = nil
+		p.blockSize = 0
+		return msg
+	}
+
+	if p.overflow {
+		return nil
+	}
+
+	p.block = append(p.block, line)
+	p.blockSize += len(line)
+
+	if len(p.block) > maxBlockLines || p.blockSize > maxBlockBytes {
+		log.Error("Management: reply too large, throwing it away")
+		p.overflow = true
+		p.block = nil
+		p.blockSize = 0
+	}
+	return nil
+} // }}}
+
+func (p *parser) notification(line string) *message { // {{{
+	msg := &message{kind: line, payload: ""}
+	if i := strings.Index(line, ":"); i >= 0 {
+		msg.kind = line[:i]
+		msg.payload = line[i+1:]
+	}
+
+	if msg.kind != "CLIENT" {
+		return msg
+	}
+
+	// >CLIENT:ENV,name=value ... >CLIENT:ENV,END
+	if strings.HasPrefix(msg.payload, "ENV,") {
+		if p.client == nil {
+			log.Error("Management: throwing away ENV data: ", msg.payload)
+			return nil
+		}
+
+		env := msg.payload[len("ENV,"):]
+		if env == "END" {
+			msg, p.client = p.client, nil
+			return msg
+		}
+
+		if i := strings.Index(env, "="); i > 0 && len(p.client.env) < maxClientEnv {
+			p.client.env[env[:i]] = env[i+1:]
+		}
+		return nil
+	}
+
+	// >CLIENT:ADDRESS has no ENV block
+	if strings.HasPrefix(msg.payload, "ADDRESS,") {
+		return msg
+	}
+
+	if p.client != nil {
+		log.Error("Management: client notification without ENV,END: ", p.client.payload)
+	}
+	msg.env = make(map[string]string, 0)
+	p.client = msg
+	return nil
+} // }}}
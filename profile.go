@@ -0,0 +1,121 @@
+package openvpn
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/stamp/go-openssl"
+)
+
+// Profile builds a self-contained .ovpn client profile, with the
+// certificates and keys inline
+type Profile struct {
+	Config *Config // The client config, ex from NewSslClient or Config.ClientMode
+
+	CA   *openssl.CA
+	Cert *openssl.Cert
+	TA   *openssl.TA
+
+	TLSCrypt bool // Use the TA key with <tls-crypt> instead of <tls-auth>
+	OmitKey  bool // Leave out the private key, to deliver it separately
+}
+
+// Render returns the profile
+func (p *Profile) Render() (string, error) {
+	files := profileFiles{tlsCrypt: p.TLSCrypt}
+	if p.CA != nil {
+		files.ca = p.CA.GetFilePath()
+	}
+	if p.Cert != nil {
+		files.cert = p.Cert.GetFilePath()
+		if !p.OmitKey {
+			files.key = p.Cert.GetKeyPath()
+		}
+	}
+	if p.TA != nil {
+		files.ta = p.TA.GetFilePath()
+	}
+
+	c, err := files.profile(p.Config)
+	if err != nil {
+		return "", err
+	}
+	return c.Render(), nil
+}
+
+// WriteFile writes the profile to a file only readable by the owner
+func (p *Profile) WriteFile(filename string) error {
+	profile, err := p.Render()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, []byte(profile), 0600)
+}
+
+type profileFiles struct {
+	ca, cert, key, ta string
+	tlsCrypt          bool
+}
+
+type inlineFile struct {
+	name, filename string
+}
+
+// profile copies the config, replacing the file options with inline blocks
+func (f profileFiles) profile(config *Config) (*Config, error) { // {{{
+	inline := []inlineFile{{"ca", f.ca}, {"cert", f.cert}, {"key", f.key}}
+	if f.tlsCrypt {
+		inline = append(inline, inlineFile{"tls-crypt", f.ta})
+	} else {
+		inline = append(inline, inlineFile{"tls-auth", f.ta})
+	}
+
+	// Options replaced by the inline blocks, or only useful on the server
+	skip := map[string]bool{
+		"dh":         true,
+		"crl-verify": true,
+	}
+	for _, i := range inline {
+		skip[i.name] = i.filename != ""
+	}
+	if f.cert != "" {
+		skip["key"] = true // An omitted key is delivered separately
+	}
+	if f.ta != "" {
+		skip["tls-auth"] = true
+		skip["tls-crypt"] = true
+		skip["key-direction"] = true
+	}
+
+	c := NewConfig()
+
+	direction := "1"
+	for _, d := range config.directives {
+		if d.name == "tls-auth" && len(d.args) > 1 {
+			direction = d.args[1]
+		}
+		if skip[d.name] || strings.HasPrefix(d.name, "management") {
+			continue
+		}
+		c.directives = append(c.directives, d)
+	}
+
+	if f.ta != "" && !f.tlsCrypt {
+		c.directives = append(c.directives, directive{name: "key-direction", args: []string{direction}})
+	}
+
+	for _, i := range inline {
+		if i.filename == "" {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(i.filename)
+		if err != nil {
+			return nil, err
+		}
+		c.directives = append(c.directives, directive{name: i.name, inline: string(content)})
+	}
+
+	c.Refresh()
+	return c, nil
+} // }}}
@@ -0,0 +1,70 @@
+package openvpn
+
+import (
+	"context"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// PromptHandler answers openvpn when it needs the user to confirm something,
+// like inserting a token (>NEED-OK), or to enter a string (>NEED-STR). A
+// prompt not handled by a PromptHandler can still be answered with
+// Process.NeedOk and Process.NeedStr after receiving the event.
+type PromptHandler interface {
+	NeedOk(name, message string) (ok bool)
+	NeedStr(name, message string) (value string, ok bool)
+}
+
+// NeedOk confirms (or cancels) a >NEED-OK prompt
+func (p *Process) NeedOk(name string, ok bool) error {
+	return p.management.needOk(name, ok)
+}
+
+// NeedStr answers a >NEED-STR prompt
+func (p *Process) NeedStr(name, value string) error {
+	return p.management.needStr(name, value)
+}
+
+func (m *Management) prompt(e TypedEvent) { // {{{
+	if m.Conn.PromptHandler == nil {
+		return
+	}
+
+	var err error
+	switch e := e.(type) {
+	case *NeedOk:
+		err = m.needOk(e.Name, m.Conn.PromptHandler.NeedOk(e.Name, e.Message))
+	case *NeedStr:
+		value, ok := m.Conn.PromptHandler.NeedStr(e.Name, e.Message)
+		if !ok {
+			log.Warn("Management: '", e.Name, "' input was cancelled")
+			return
+		}
+		err = m.needStr(e.Name, value)
+	}
+
+	if err != nil {
+		log.Error("Management: failed to answer prompt: ", err)
+	}
+} // }}}
+
+func (m *Management) needOk(name string, ok bool) error { // {{{
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	answer := "cancel"
+	if ok {
+		answer = "ok"
+	}
+
+	_, err := m.Command(ctx, "needok "+quote(name)+" "+answer)
+	return err
+} // }}}
+func (m *Management) needStr(name, value string) error { // {{{
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, err := m.Command(ctx, "needstr "+quote(name)+" "+quote(value))
+	return err
+} // }}}
@@ -0,0 +1,61 @@
+package openvpn
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	log "github.com/cihub/seelog"
+)
+
+// Signal is a signal understood by openvpn
+type Signal string
+
+const (
+	SIGHUP  Signal = "SIGHUP"  // Hard restart, rereads the config and CRL
+	SIGTERM Signal = "SIGTERM" // Exit
+	SIGUSR1 Signal = "SIGUSR1" // Soft restart, keeps the tun device and keys with persist-tun and persist-key
+	SIGUSR2 Signal = "SIGUSR2" // Writes the statistics to the log
+)
+
+// ErrNotRunning is returned when a signal can't be delivered because openvpn isnt running
+var ErrNotRunning = errors.New("openvpn: not running")
+
+// Signal sends a signal to openvpn through the management interface
+// (management-signal). An OS signal is sent to the child process if the
+// management interface isnt connected.
+func (p *Process) Signal(ctx context.Context, sig Signal) error { // {{{
+	switch sig {
+	case SIGHUP, SIGTERM, SIGUSR1, SIGUSR2:
+	default:
+		return errors.New("openvpn: unknown signal " + string(sig))
+	}
+
+	_, err := p.Command(ctx, "signal "+string(sig))
+	if err != ErrNotConnected {
+		return err
+	}
+
+	p.lock.Lock()
+	cmd := p.cmd
+	p.lock.Unlock()
+
+	if cmd == nil || cmd.Process == nil {
+		return ErrNotRunning
+	}
+
+	log.Warn("Management not connected, sending ", sig, " to pid ", cmd.Process.Pid)
+	return osSignal(cmd.Process, sig)
+} // }}}
+
+// Verb changes the log verbosity (0-11) of the running openvpn
+func (p *Process) Verb(ctx context.Context, level int) error {
+	_, err := p.Command(ctx, "verb "+strconv.Itoa(level))
+	return err
+}
+
+// Mute changes how many repeating messages of the same category openvpn logs
+func (p *Process) Mute(ctx context.Context, n int) error {
+	_, err := p.Command(ctx, "mute "+strconv.Itoa(n))
+	return err
+}
@@ -0,0 +1,16 @@
+package openvpn
+
+import (
+	"os"
+	"syscall"
+)
+
+func osSignal(process *os.Process, sig Signal) error {
+	signals := map[Signal]os.Signal{
+		SIGHUP:  syscall.SIGHUP,
+		SIGTERM: syscall.SIGTERM,
+		SIGUSR1: syscall.SIGUSR1,
+		SIGUSR2: syscall.SIGUSR2,
+	}
+	return process.Signal(signals[sig])
+}
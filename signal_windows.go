@@ -0,0 +1,14 @@
+package openvpn
+
+import (
+	"errors"
+	"os"
+)
+
+// Windows can only kill the process, the other signals needs the management interface
+func osSignal(process *os.Process, sig Signal) error {
+	if sig != SIGTERM {
+		return errors.New("openvpn: " + string(sig) + " can only be sent through the management interface on windows")
+	}
+	return process.Kill()
+}
@@ -0,0 +1,284 @@
+package openvpn
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status is the decoded reply to the "status" command, or the content of a
+// status file written with "status-version"
+type Status struct {
+	Version     int // 1, 2 or 3
+	Title       string
+	Updated     time.Time
+	Clients     []StatusClient
+	Routes      []StatusRoute
+	GlobalStats map[string]string
+}
+
+// StatusClient is a row of the CLIENT_LIST
+type StatusClient struct {
+	CommonName         string
+	RealAddress        string
+	VirtualAddress     string
+	VirtualIPv6Address string
+	BytesReceived      uint64
+	BytesSent          uint64
+	ConnectedSince     time.Time
+	Username           string
+	ClientID           string
+	PeerID             string
+	DataChannelCipher  string
+}
+
+// StatusRoute is a row of the ROUTING_TABLE
+type StatusRoute struct {
+	VirtualAddress string
+	CommonName     string
+	RealAddress    string
+	LastRef        time.Time
+}
+
+// The layout of the human readable timestamps in status output
+const statusTimeLayout = "Mon Jan _2 15:04:05 2006"
+
+// Status fetches the status from openvpn using the tab delimited version 3 format
+func (p *Process) Status(ctx context.Context) (*Status, error) {
+	resp, err := p.Command(ctx, "status 3")
+	if err != nil {
+		return nil, err
+	}
+	return ParseStatus(resp.Lines)
+}
+
+// ParseStatus decodes status output in version 1, 2 or 3 format. The lines
+// should not include the trailing END.
+func ParseStatus(lines []string) (*Status, error) { // {{{
+	if len(lines) == 0 {
+		return nil, errors.New("openvpn: empty status")
+	}
+
+	switch {
+	case lines[0] == "OpenVPN CLIENT LIST":
+		return parseStatusV1Lines(lines)
+	case strings.HasPrefix(lines[0], "TITLE\t"), strings.HasPrefix(lines[0], "HEADER\t"):
+		return parseStatusRows(lines, "\t", 3)
+	case strings.HasPrefix(lines[0], "TITLE,"), strings.HasPrefix(lines[0], "HEADER,"):
+		return parseStatusRows(lines, ",", 2)
+	}
+
+	return nil, errors.New("openvpn: unknown status format: " + lines[0])
+} // }}}
+
+// parseStatusRows decodes the version 2 and 3 formats, where every row starts
+// with its type and the columns are described by HEADER rows
+//
+//	TITLE	OpenVPN 2.4.4 x86_64-pc-linux-gnu
+//	TIME	Thu Feb 13 23:39:20 2014	1392331160
+//	HEADER	CLIENT_LIST	Common Name	Real Address	Virtual Address	...
+//	CLIENT_LIST	VPN_client	10.13.156.4:1194	10.8.0.6	...
+//	HEADER	ROUTING_TABLE	Virtual Address	Common Name	Real Address	Last Ref	Last Ref (time_t)
+//	ROUTING_TABLE	10.8.0.6	VPN_client	10.13.156.4:1194	Thu Feb 13 23:39:20 2014	1392331160
+//	GLOBAL_STATS	Max bcast/mcast queue length	0
+func parseStatusRows(lines []string, delimiter string, version int) (*Status, error) { // {{{
+	status := &Status{
+		Version:     version,
+		Clients:     make([]StatusClient, 0),
+		Routes:      make([]StatusRoute, 0),
+		GlobalStats: make(map[string]string, 0),
+	}
+
+	// Column names by row type, the defaults are used if openvpn sends no HEADER
+	headers := map[string][]string{
+		"CLIENT_LIST":   {"Common Name", "Real Address", "Virtual Address", "Virtual IPv6 Address", "Bytes Received", "Bytes Sent", "Connected Since", "Connected Since (time_t)", "Username", "Client ID", "Peer ID", "Data Channel Cipher"},
+		"ROUTING_TABLE": {"Virtual Address", "Common Name", "Real Address", "Last Ref", "Last Ref (time_t)"},
+	}
+
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, delimiter)
+		values := fields[1:]
+
+		switch fields[0] {
+		case "TITLE":
+			status.Title = strings.Join(values, delimiter)
+		case "TIME":
+			if len(values) > 1 {
+				status.Updated = parseUnixTime(values[1])
+			} else if len(values) > 0 {
+				status.Updated, _ = time.ParseInLocation(statusTimeLayout, values[0], time.Local)
+			}
+		case "HEADER":
+			if len(values) > 0 {
+				headers[values[0]] = values[1:]
+			}
+		case "CLIENT_LIST":
+			row := statusRow(headers[fields[0]], values)
+			status.Clients = append(status.Clients, StatusClient{
+				CommonName:         row["Common Name"],
+				RealAddress:        row["Real Address"],
+				VirtualAddress:     row["Virtual Address"],
+				VirtualIPv6Address: row["Virtual IPv6 Address"],
+				BytesReceived:      parseCounter(row["Bytes Received"]),
+				BytesSent:          parseCounter(row["Bytes Sent"]),
+				ConnectedSince:     parseStatusTime(row["Connected Since"], row["Connected Since (time_t)"]),
+				Username:           row["Username"],
+				ClientID:           row["Client ID"],
+				PeerID:             row["Peer ID"],
+				DataChannelCipher:  row["Data Channel Cipher"],
+			})
+		case "ROUTING_TABLE":
+			row := statusRow(headers[fields[0]], values)
+			status.Routes = append(status.Routes, StatusRoute{
+				VirtualAddress: row["Virtual Address"],
+				CommonName:     row["Common Name"],
+				RealAddress:    row["Real Address"],
+				LastRef:        parseStatusTime(row["Last Ref"], row["Last Ref (time_t)"]),
+			})
+		case "GLOBAL_STATS":
+			if len(values) > 1 {
+				status.GlobalStats[values[0]] = values[1]
+			}
+		case "END":
+			return status, nil
+		}
+	}
+
+	return status, nil
+} // }}}
+
+// parseStatusV1Lines decodes the version 1 format, see parseStatusV1
+func parseStatusV1Lines(lines []string) (*Status, error) { // {{{
+	clients, routes, ok := parseStatusV1(lines)
+	if !ok {
+		return nil, errors.New("openvpn: invalid client list")
+	}
+
+	status := &Status{
+		Version:     1,
+		Clients:     make([]StatusClient, 0, len(clients)),
+		Routes:      make([]StatusRoute, 0, len(routes)),
+		GlobalStats: make(map[string]string, 0),
+	}
+
+	if len(lines) > 1 && strings.HasPrefix(lines[1], "Updated,") {
+		status.Updated = parseStatusTime(strings.TrimPrefix(lines[1], "Updated,"), "")
+	}
+
+	for _, c := range clients {
+		status.Clients = append(status.Clients, StatusClient{
+			CommonName:     c["Common Name"],
+			RealAddress:    c["Real Address"],
+			BytesReceived:  parseCounter(c["Bytes Received"]),
+			BytesSent:      parseCounter(c["Bytes Sent"]),
+			ConnectedSince: parseStatusTime(c["Connected Since"], ""),
+		})
+	}
+	for _, r := range routes {
+		status.Routes = append(status.Routes, StatusRoute{
+			VirtualAddress: r["Virtual Address"],
+			CommonName:     r["Common Name"],
+			RealAddress:    r["Real Address"],
+			LastRef:        parseStatusTime(r["Last Ref"], ""),
+		})
+	}
+
+	// Fill in the virtual address, which version 1 only lists in the routing table
+	for i, c := range status.Clients {
+		for _, r := range status.Routes {
+			if r.CommonName == c.CommonName && r.RealAddress == c.RealAddress {
+				status.Clients[i].VirtualAddress = r.VirtualAddress
+				break
+			}
+		}
+	}
+
+	return status, nil
+} // }}}
+
+// parseStatusV1 splits a version 1 status reply into the client list and the routing table
+//
+//	OpenVPN CLIENT LIST
+//	Updated,Thu Feb 13 23:39:20 2014
+//	Common Name,Real Address,Bytes Received,Bytes Sent,Connected Since
+//	VPN_client,10.13.156.4:1194,12563,14885,Thu Feb 13 23:39:20 2014
+//	ROUTING TABLE
+//	Virtual Address,Common Name,Real Address,Last Ref
+//	192.168.11.4,VPN_client,10.13.156.4:1194,Thu Feb 13 23:39:20 2014
+//	GLOBAL STATS
+//	Max bcast/mcast queue length,0
+func parseStatusV1(lines []string) (clients, routes []map[string]string, ok bool) { // {{{
+	sections := make(map[string][]string, 0)
+	section := ""
+
+	for _, line := range lines {
+		switch {
+		case line == "":
+		case line == "OpenVPN CLIENT LIST", line == "ROUTING TABLE", line == "GLOBAL STATS":
+			section = line
+		case strings.HasPrefix(line, "Updated,") && section == "OpenVPN CLIENT LIST" && len(sections[section]) == 0:
+		default:
+			sections[section] = append(sections[section], line)
+		}
+	}
+
+	if len(sections["OpenVPN CLIENT LIST"]) == 0 || len(sections["ROUTING TABLE"]) == 0 {
+		return nil, nil, false
+	}
+
+	clients = makeCsvList(strings.Join(sections["OpenVPN CLIENT LIST"], "\n"))
+	routes = makeCsvList(strings.Join(sections["ROUTING TABLE"], "\n"))
+	return clients, routes, true
+} // }}}
+
+func makeCsvList(data string) (list []map[string]string) { // {{{
+	list = make([]map[string]string, 0)
+
+	rows := strings.Split(data, "\n")
+
+	cols := strings.Split(rows[0], ",")
+
+	for i, row := range rows[1:] {
+		values := strings.Split(row, ",")
+
+		list = append(list, make(map[string]string, 0))
+
+		for c, col := range cols {
+			if c < len(values) {
+				list[i][col] = values[c]
+			}
+		}
+	}
+	return
+} // }}}
+
+func statusRow(header, values []string) map[string]string {
+	row := make(map[string]string, len(header))
+	for i, name := range header {
+		if i < len(values) {
+			row[name] = values[i]
+		}
+	}
+	return row
+}
+
+func parseCounter(s string) uint64 {
+	n, _ := strconv.ParseUint(s, 10, 64)
+	return n
+}
+
+// parseStatusTime prefers the unix timestamp when openvpn provides one
+func parseStatusTime(text, unix string) time.Time {
+	if unix != "" {
+		return parseUnixTime(unix)
+	}
+
+	t, _ := time.ParseInLocation(statusTimeLayout, strings.TrimSpace(text), time.Local)
+	return t
+}
@@ -0,0 +1,117 @@
+package openvpn
+
+import (
+	"context"
+	"os/exec"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// defaultStopTimeout is how long each step of the shutdown waits for openvpn to exit
+const defaultStopTimeout = time.Second * 10
+
+// StopMethod tells which step of the shutdown ended the process
+type StopMethod string
+
+const (
+	StopExited     StopMethod = "exited"     // The process exited by itself
+	StopManagement StopMethod = "management" // SIGTERM sent through the management interface
+	StopSignal     StopMethod = "signal"     // SIGTERM sent by the OS
+	StopKill       StopMethod = "kill"       // SIGKILL
+)
+
+// terminate stops openvpn in order, giving it a chance to send
+// explicit-exit-notify and to remove the tun device and routes:
+//
+//  1. "signal SIGTERM" on the management interface, waiting for EXITING and the exit
+//  2. SIGTERM from the OS
+//  3. SIGKILL
+//
+// Each step waits Process.StopTimeout for the process to exit. The cmd is the
+// one watched by ProcessMonitor, it must have been started (or failed to).
+func (p *Process) terminate(cmd *exec.Cmd, done chan error) (StopMethod, error) { // {{{
+	timeout := p.StopTimeout
+	if timeout <= 0 {
+		timeout = defaultStopTimeout
+	}
+
+	// Nothing to stop if openvpn failed to start
+	if cmd.Process == nil {
+		return StopExited, <-done
+	}
+
+	p.lock.Lock()
+	exiting := p.exiting
+	p.lock.Unlock()
+
+	// 1. Ask openvpn to exit through the management interface
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	_, err := p.Command(ctx, "signal SIGTERM")
+	cancel()
+
+	if err == nil {
+		deadline := time.After(timeout)
+	wait:
+		for {
+			select {
+			case err := <-done:
+				return StopManagement, err
+			case <-exiting:
+				log.Info("Openvpn is exiting")
+				exiting = nil
+			case <-deadline:
+				break wait
+			}
+		}
+		log.Warn("Openvpn did not exit within ", timeout, " after SIGTERM from the management interface")
+	} else {
+		log.Warn("Failed to send SIGTERM through the management interface: ", err)
+	}
+
+	// 2. SIGTERM from the OS
+	if err := osSignal(cmd.Process, SIGTERM); err == nil {
+		select {
+		case err := <-done:
+			return StopSignal, err
+		case <-time.After(timeout):
+			log.Warn("Openvpn did not exit within ", timeout, " after SIGTERM")
+		}
+	} else {
+		log.Warn("Failed to send SIGTERM: ", err)
+	}
+
+	// 3. Kill it
+	if err := cmd.Process.Kill(); err != nil {
+		log.Error("Failed to kill openvpn: ", err)
+	}
+	return StopKill, <-done
+} // }}}
+
+// stopping tells if Stop has been called since openvpn was started
+func (p *Process) stopping() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	select {
+	case <-p.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// setExiting is called when openvpn reports the EXITING state
+func (p *Process) setExiting() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.exiting == nil {
+		return
+	}
+	select {
+	case <-p.exiting:
+	default:
+		close(p.exiting)
+	}
+}
@@ -0,0 +1,171 @@
+package openvpn
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// Supervisor restarts openvpn when it exits unexpectedly. Restarts are
+// delayed with an exponential backoff, and the supervisor gives up when
+// openvpn fails with a fatal error (>FATAL: or an options error) or restarts
+// too often.
+type Supervisor struct {
+	Process *Process
+
+	MinBackoff    time.Duration // Delay before the first restart, doubled for every failure
+	MaxBackoff    time.Duration // Longest delay between restarts
+	Jitter        float64       // Random part of the delay, 0.2 gives +-20%
+	MaxRestarts   int           // Give up after this many restarts within RestartWindow
+	RestartWindow time.Duration // A process running longer than this resets the backoff
+
+	stop     chan bool
+	done     chan bool
+	stopOnce sync.Once
+}
+
+func NewSupervisor(p *Process) *Supervisor {
+	return &Supervisor{
+		Process: p,
+
+		MinBackoff:    time.Second,
+		MaxBackoff:    time.Minute,
+		Jitter:        0.2,
+		MaxRestarts:   10,
+		RestartWindow: time.Minute * 10,
+
+		stop: make(chan bool),
+		done: make(chan bool),
+	}
+}
+
+// Start starts openvpn and keeps it running until Stop is called
+func (s *Supervisor) Start() error {
+	if err := s.Process.Start(); err != nil {
+		return err
+	}
+
+	go s.run()
+	return nil
+}
+
+// Stop stops the supervisor and openvpn
+func (s *Supervisor) Stop() error {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+
+	return s.Process.Stop()
+}
+
+func (s *Supervisor) run() { // {{{
+	defer close(s.done)
+
+	restarts := make([]time.Time, 0)
+	failures := 0
+
+	for {
+		started := time.Now()
+
+		select {
+		case <-s.Process.Stopped:
+		case <-s.stop:
+			return
+		}
+
+		// Stopped on purpose, by us or with Process.Stop
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		if s.Process.stopping() {
+			return
+		}
+
+		// Config errors doesnt go away by themselves
+		if fatal := s.Process.fatalMessage(); fatal != "" {
+			s.giveUp(fatal, true)
+			return
+		}
+
+		now := time.Now()
+		if now.Sub(started) > s.RestartWindow {
+			failures = 0
+		}
+		failures++
+
+		// Cap the restart rate
+		recent := restarts[:0]
+		for _, t := range restarts {
+			if now.Sub(t) < s.RestartWindow {
+				recent = append(recent, t)
+			}
+		}
+		restarts = append(recent, now)
+		if s.MaxRestarts > 0 && len(restarts) > s.MaxRestarts {
+			s.giveUp("restarted too often", false)
+			return
+		}
+
+		delay := s.backoff(failures)
+		reason := "unexpected exit"
+		if err := s.Process.ExitStatus(); err != nil {
+			reason = err.Error()
+		}
+
+		log.Warn("Openvpn stopped (", reason, "), restarting in ", delay)
+		s.Process.emit(&Restarting{
+			Attempt: failures,
+			Delay:   delay,
+			Reason:  reason,
+		})
+
+		select {
+		case <-time.After(delay):
+		case <-s.stop:
+			return
+		}
+
+		if s.Process.stopping() {
+			return
+		}
+		if err := s.Process.Restart(); err != nil {
+			s.giveUp(err.Error(), true)
+			return
+		}
+	}
+} // }}}
+
+// backoff returns the delay before the restart after the given number of failures
+func (s *Supervisor) backoff(failures int) time.Duration {
+	delay := s.MinBackoff
+	for i := 1; i < failures && delay < s.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.MaxBackoff {
+		delay = s.MaxBackoff
+	}
+
+	if s.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * s.Jitter * float64(delay))
+	}
+	return delay
+}
+
+func (s *Supervisor) giveUp(reason string, fatal bool) {
+	log.Error("Openvpn supervisor gave up: ", reason)
+	s.Process.emit(&GaveUp{
+		Reason: reason,
+		Fatal:  fatal,
+	})
+}
+
+// isFatal tells if an output line from openvpn means that restarting it wont help
+func isFatal(line string) bool {
+	return strings.Contains(line, "Options error:")
+}
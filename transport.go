@@ -0,0 +1,83 @@
+package openvpn
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Transport decides how openvpn reaches the management interface. The library
+// listens and openvpn connects to it (management-client).
+type Transport interface {
+	// Listen opens the socket openvpn will connect to
+	Listen() (net.Listener, error)
+	// Directive returns the arguments for the "management" option, quoted as
+	// in a config file. The passwordFile is empty when no password is used.
+	Directive(l net.Listener, passwordFile string) string
+}
+
+// UnixTransport uses a unix domain socket, "management socket-name unix [pw-file]"
+type UnixTransport struct {
+	Path string
+}
+
+func (t *UnixTransport) Listen() (net.Listener, error) {
+	// Remove sockets left behind by a crashed process, but not one that is
+	// still in use
+	if c, err := net.Dial("unix", t.Path); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("openvpn: management socket %s is already in use", t.Path)
+	} else if errors.Is(err, syscall.ECONNREFUSED) {
+		os.Remove(t.Path)
+	}
+
+	return net.Listen("unix", t.Path)
+}
+
+func (t *UnixTransport) Directive(l net.Listener, passwordFile string) string {
+	directive := quoteArg(t.Path) + " unix"
+	if passwordFile != "" {
+		directive += " " + quoteArg(passwordFile)
+	}
+	return directive
+}
+
+// TCPTransport uses tcp, "management IP port [pw-file]". Use it where unix
+// sockets can't be shared, ex between containers. The address should be on the
+// loopback interface, set a Management.Password if other users on the host may
+// reach it. Port 0 picks a free port.
+type TCPTransport struct {
+	Address string // ex 127.0.0.1:0
+}
+
+func (t *TCPTransport) Listen() (net.Listener, error) {
+	return net.Listen("tcp", t.Address)
+}
+
+func (t *TCPTransport) Directive(l net.Listener, passwordFile string) string {
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	directive := host + " " + port
+	if passwordFile != "" {
+		directive += " " + quoteArg(passwordFile)
+	}
+	return directive
+}
+
+// writePasswordFile stores the management password where only we and openvpn can read it
+func writePasswordFile(password string) (string, error) {
+	f, err := ioutil.TempFile("", "openvpn-management-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(password + "\n"); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}